@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// Mix is the relative frequency of the operations performed by Suite.BenchmarkMixed
+type Mix struct {
+	Load   int
+	Exists int
+	Store  int
+	List   int
+	Lock   int
+}
+
+// DefaultMix approximates the storage access pattern of certmagic:
+// mostly loading and checking certificates, occasional renewals,
+// and periodic cleanup scans.
+var DefaultMix = Mix{
+	Load:   60,
+	Exists: 25,
+	Store:  8,
+	List:   4,
+	Lock:   3,
+}
+
+// benchmarkSites is the number of sites whose keys BenchmarkMixed operates on
+const benchmarkSites = 100
+
+// BenchmarkMixed benchmarks the Storage with a mix of operations
+// given by ts.Mix, or DefaultMix if it's not set, and reports ops/s.
+//
+// A Lock operation is a Lock and Unlock pair.
+func (ts *Suite) BenchmarkMixed(b *testing.B) {
+	ts.checkStorage(b)
+	b.Cleanup(func() {
+		ts.cleanup(context.Background(), ts.S)
+	})
+	defer ts.recoverPanic(b)
+	ts.warmup(b)
+
+	mix := ts.Mix
+	if mix == (Mix{}) {
+		mix = DefaultMix
+	}
+	total := mix.Load + mix.Exists + mix.Store + mix.List + mix.Lock
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	keys := make([]string, benchmarkSites)
+	val := patternValue(4 << 10)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%s/site%d.example.com/site%d.example.com.crt", dir, i, i)
+		if err := sto.Store(b.Context(), keys[i], val); err != nil {
+			b.Fatalf("Store(%s) failed: %s", keys[i], err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := keys[ts.Rng.Int()%len(keys)]
+		switch n := ts.Rng.Int() % total; {
+		case n < mix.Load:
+			if _, err := sto.Load(b.Context(), key); err != nil {
+				b.Fatalf("Load(%s) failed: %s", key, err)
+			}
+		case n < mix.Load+mix.Exists:
+			if !sto.Exists(b.Context(), key) {
+				b.Fatalf("Stored key %s doesn't exists", key)
+			}
+		case n < mix.Load+mix.Exists+mix.Store:
+			if err := sto.Store(b.Context(), key, val); err != nil {
+				b.Fatalf("Store(%s) failed: %s", key, err)
+			}
+		case n < mix.Load+mix.Exists+mix.Store+mix.List:
+			if _, err := sto.List(b.Context(), dir, false); err != nil {
+				b.Fatalf("List(%s, false) failed: %s", dir, err)
+			}
+		default:
+			if err := sto.Lock(b.Context(), key); err != nil {
+				b.Fatalf("Storage fails to lock key: %s", err)
+			}
+			if err := sto.Unlock(b.Context(), key); err != nil {
+				b.Fatalf("Storage fails to unlock locked key: %s", err)
+			}
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "ops/s")
+}
@@ -0,0 +1,144 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// consistentStorage waits after each Store and Delete of a certmagic.Storage
+// until its effect is visible, so that tests can read their own writes
+// from a Storage that is only eventually consistent
+type consistentStorage struct {
+	certmagic.Storage
+
+	// loads, exists and lists tell which reads must see the effect
+	loads, exists, lists bool
+	// rootList is false if List of the empty prefix fails
+	rootList bool
+
+	mu   sync.Mutex
+	seq  int64
+	last map[string]int64
+}
+
+func newConsistentStorage(s certmagic.Storage, ts *Suite) *consistentStorage {
+	return &consistentStorage{
+		Storage:  s,
+		loads:    ts.AsyncWrites,
+		exists:   ts.AsyncWrites || ts.ExistsEventuallyConsistent,
+		lists:    ts.AsyncWrites || ts.ListEventuallyConsistent,
+		rootList: !ts.RejectEmptyPrefix,
+		last:     map[string]int64{},
+	}
+}
+
+// begin records a write of key, and returns its sequence number
+func (cs *consistentStorage) begin(key string) int64 {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.seq++
+	cs.last[key] = cs.seq
+	return cs.seq
+}
+
+// superseded reports whether a write of key, of a key under it
+// or of one of its parents began after the write numbered seq
+func (cs *consistentStorage) superseded(key string, seq int64) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for k, s := range cs.last {
+		if s > seq && (k == key || strings.HasPrefix(k, key+"/") || strings.HasPrefix(key, k+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// wait polls visible until it returns true, the write of key numbered seq
+// is superseded by a later write, or ctx is done, and returns false
+// if none of them happens before consistencyTimeout
+func (cs *consistentStorage) wait(ctx context.Context, key string, seq int64, visible func() bool) bool {
+	deadline := time.Now().Add(consistencyTimeout)
+	for d := time.Millisecond; ; d = min(2*d, 100*time.Millisecond) {
+		if visible() || cs.superseded(key, seq) || ctx.Err() != nil {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(d)
+	}
+}
+
+// listed reports whether List of the parent of key returns it,
+// or ok if that can't be checked because List of the root fails
+func (cs *consistentStorage) listed(ctx context.Context, key string, ok bool) bool {
+	parent := ""
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		parent = key[:i]
+	}
+	if parent == "" && !cs.rootList {
+		return ok
+	}
+	ls, err := cs.Storage.List(ctx, parent, false)
+	return err == nil && slices.Contains(ls, key)
+}
+
+func (cs *consistentStorage) Store(ctx context.Context, key string, value []byte) error {
+	seq := cs.begin(key)
+	if err := cs.Storage.Store(ctx, key, value); err != nil {
+		return err
+	}
+	ok := cs.wait(ctx, key, seq, func() bool {
+		if cs.loads {
+			if s, err := cs.Storage.Load(ctx, key); err != nil || !bytes.Equal(value, s) {
+				return false
+			}
+		}
+		if cs.exists && !cs.Storage.Exists(ctx, key) {
+			return false
+		}
+		return !cs.lists || cs.listed(ctx, key, true)
+	})
+	if !ok {
+		return fmt.Errorf("Store(%s) returned, but its value isn't visible after %s", key, consistencyTimeout)
+	}
+	return nil
+}
+
+func (cs *consistentStorage) Delete(ctx context.Context, key string) error {
+	seq := cs.begin(key)
+	if err := cs.Storage.Delete(ctx, key); err != nil {
+		return err
+	}
+	ok := cs.wait(ctx, key, seq, func() bool {
+		if cs.loads {
+			if _, err := cs.Storage.Stat(ctx, key); err == nil {
+				return false
+			}
+		}
+		if cs.exists && cs.Storage.Exists(ctx, key) {
+			return false
+		}
+		return !cs.lists || !cs.listed(ctx, key, false)
+	})
+	if !ok {
+		return fmt.Errorf("Delete(%s) returned, but the key is still visible after %s", key, consistencyTimeout)
+	}
+	return nil
+}
+
+// ListStream must only be called if streamingLister(cs) returns true
+func (cs *consistentStorage) ListStream(ctx context.Context, path string, recursive bool, f func(key string) error) error {
+	sl, _ := streamingLister(cs.Storage)
+	return sl.ListStream(ctx, path, recursive, f)
+}
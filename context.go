@@ -0,0 +1,59 @@
+package tests
+
+import (
+	"context"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// contextStorage wraps the context of each operation of a certmagic.Storage
+type contextStorage struct {
+	certmagic.Storage
+
+	decorate func(context.Context) context.Context
+}
+
+func newContextStorage(s certmagic.Storage, decorate func(context.Context) context.Context) *contextStorage {
+	return &contextStorage{
+		Storage:  s,
+		decorate: decorate,
+	}
+}
+
+func (cs *contextStorage) Lock(ctx context.Context, name string) error {
+	return cs.Storage.Lock(cs.decorate(ctx), name)
+}
+
+func (cs *contextStorage) Unlock(ctx context.Context, name string) error {
+	return cs.Storage.Unlock(cs.decorate(ctx), name)
+}
+
+func (cs *contextStorage) Store(ctx context.Context, key string, value []byte) error {
+	return cs.Storage.Store(cs.decorate(ctx), key, value)
+}
+
+func (cs *contextStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	return cs.Storage.Load(cs.decorate(ctx), key)
+}
+
+func (cs *contextStorage) Delete(ctx context.Context, key string) error {
+	return cs.Storage.Delete(cs.decorate(ctx), key)
+}
+
+func (cs *contextStorage) Exists(ctx context.Context, key string) bool {
+	return cs.Storage.Exists(cs.decorate(ctx), key)
+}
+
+func (cs *contextStorage) List(ctx context.Context, path string, recursive bool) ([]string, error) {
+	return cs.Storage.List(cs.decorate(ctx), path, recursive)
+}
+
+func (cs *contextStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	return cs.Storage.Stat(cs.decorate(ctx), key)
+}
+
+// ListStream must only be called if streamingLister(cs) returns true
+func (cs *contextStorage) ListStream(ctx context.Context, path string, recursive bool, f func(key string) error) error {
+	sl, _ := streamingLister(cs.Storage)
+	return sl.ListStream(cs.decorate(ctx), path, recursive, f)
+}
@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"context"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// latencyStorage delays each operation of a certmagic.Storage,
+// like a backend over a slow network
+type latencyStorage struct {
+	certmagic.Storage
+
+	latency time.Duration
+}
+
+func newLatencyStorage(s certmagic.Storage, latency time.Duration) *latencyStorage {
+	return &latencyStorage{
+		Storage: s,
+		latency: latency,
+	}
+}
+
+// delay waits for the latency, or until ctx is done
+func (ls *latencyStorage) delay(ctx context.Context) error {
+	tm := time.NewTimer(ls.latency)
+	defer tm.Stop()
+	select {
+	case <-tm.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ls *latencyStorage) Lock(ctx context.Context, name string) error {
+	if err := ls.delay(ctx); err != nil {
+		return err
+	}
+	return ls.Storage.Lock(ctx, name)
+}
+
+func (ls *latencyStorage) Unlock(ctx context.Context, name string) error {
+	if err := ls.delay(ctx); err != nil {
+		return err
+	}
+	return ls.Storage.Unlock(ctx, name)
+}
+
+func (ls *latencyStorage) Store(ctx context.Context, key string, value []byte) error {
+	if err := ls.delay(ctx); err != nil {
+		return err
+	}
+	return ls.Storage.Store(ctx, key, value)
+}
+
+func (ls *latencyStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	if err := ls.delay(ctx); err != nil {
+		return nil, err
+	}
+	return ls.Storage.Load(ctx, key)
+}
+
+func (ls *latencyStorage) Delete(ctx context.Context, key string) error {
+	if err := ls.delay(ctx); err != nil {
+		return err
+	}
+	return ls.Storage.Delete(ctx, key)
+}
+
+func (ls *latencyStorage) Exists(ctx context.Context, key string) bool {
+	return ls.delay(ctx) == nil && ls.Storage.Exists(ctx, key)
+}
+
+func (ls *latencyStorage) List(ctx context.Context, path string, recursive bool) ([]string, error) {
+	if err := ls.delay(ctx); err != nil {
+		return nil, err
+	}
+	return ls.Storage.List(ctx, path, recursive)
+}
+
+func (ls *latencyStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	if err := ls.delay(ctx); err != nil {
+		return certmagic.KeyInfo{}, err
+	}
+	return ls.Storage.Stat(ctx, key)
+}
+
+// ListStream must only be called if streamingLister(ls) returns true
+func (ls *latencyStorage) ListStream(ctx context.Context, path string, recursive bool, f func(key string) error) error {
+	if err := ls.delay(ctx); err != nil {
+		return err
+	}
+	sl, _ := streamingLister(ls.Storage)
+	return sl.ListStream(ctx, path, recursive, f)
+}
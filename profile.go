@@ -0,0 +1,105 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// profiledStorage records the latency of each operation of a certmagic.Storage
+type profiledStorage struct {
+	certmagic.Storage
+
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+}
+
+func newProfiledStorage(s certmagic.Storage) *profiledStorage {
+	return &profiledStorage{
+		Storage:   s,
+		latencies: map[string][]time.Duration{},
+	}
+}
+
+func (ps *profiledStorage) record(op string, start time.Time) {
+	d := time.Since(start)
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.latencies[op] = append(ps.latencies[op], d)
+}
+
+func (ps *profiledStorage) Lock(ctx context.Context, name string) error {
+	defer ps.record("Lock", time.Now())
+	return ps.Storage.Lock(ctx, name)
+}
+
+func (ps *profiledStorage) Unlock(ctx context.Context, name string) error {
+	defer ps.record("Unlock", time.Now())
+	return ps.Storage.Unlock(ctx, name)
+}
+
+func (ps *profiledStorage) Store(ctx context.Context, key string, value []byte) error {
+	defer ps.record("Store", time.Now())
+	return ps.Storage.Store(ctx, key, value)
+}
+
+func (ps *profiledStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	defer ps.record("Load", time.Now())
+	return ps.Storage.Load(ctx, key)
+}
+
+func (ps *profiledStorage) Delete(ctx context.Context, key string) error {
+	defer ps.record("Delete", time.Now())
+	return ps.Storage.Delete(ctx, key)
+}
+
+func (ps *profiledStorage) Exists(ctx context.Context, key string) bool {
+	defer ps.record("Exists", time.Now())
+	return ps.Storage.Exists(ctx, key)
+}
+
+func (ps *profiledStorage) List(ctx context.Context, path string, recursive bool) ([]string, error) {
+	defer ps.record("List", time.Now())
+	return ps.Storage.List(ctx, path, recursive)
+}
+
+func (ps *profiledStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	defer ps.record("Stat", time.Now())
+	return ps.Storage.Stat(ctx, key)
+}
+
+// ListStream must only be called if streamingLister(ps) returns true
+func (ps *profiledStorage) ListStream(ctx context.Context, path string, recursive bool, f func(key string) error) error {
+	defer ps.record("ListStream", time.Now())
+	sl, _ := streamingLister(ps.Storage)
+	return sl.ListStream(ctx, path, recursive, f)
+}
+
+// report returns a table of the latency distribution of each operation
+func (ps *profiledStorage) report() string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%-10s %8s %12s %12s %12s %12s %12s\n", "op", "count", "min", "p50", "p90", "p99", "max")
+	ops := make([]string, 0, len(ps.latencies))
+	for op := range ps.latencies {
+		ops = append(ops, op)
+	}
+	slices.Sort(ops)
+	for _, op := range ops {
+		ds := slices.Clone(ps.latencies[op])
+		slices.Sort(ds)
+		p := func(n int) time.Duration {
+			return ds[(len(ds)-1)*n/100]
+		}
+		fmt.Fprintf(b, "%-10s %8d %12s %12s %12s %12s %12s\n", op, len(ds), ds[0], p(50), p(90), p(99), ds[len(ds)-1])
+	}
+	return b.String()
+}
@@ -21,21 +21,60 @@ package tests
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io/fs"
 	"math/rand"
 	"runtime"
+	"runtime/debug"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/caddyserver/certmagic"
 )
 
+// DefaultLargeListSize is the default value of Suite.LargeListSize.
+// It exceeds the page size of common object storage APIs.
+const DefaultLargeListSize = 2000
+
+// DefaultConcurrency is the default value of Suite.Concurrency
+const DefaultConcurrency = 16
+
+// DefaultLargeValueSize is the default value of Suite.LargeValueSize
+const DefaultLargeValueSize = 8 << 20
+
+// DefaultOverwriteValueSize is the default value of Suite.OverwriteValueSize
+const DefaultOverwriteValueSize = 256 << 10
+
+// DefaultMaxKeyDepth is the default value of Suite.MaxKeyDepth
+const DefaultMaxKeyDepth = 50
+
+// DefaultChecksumBytes is the default value of Suite.ChecksumBytes
+const DefaultChecksumBytes = 64 << 20
+
+// ErrValueTooLarge may be wrapped by the error returned by Store
+// of a value larger than Suite.MaxValueSize, when Suite.RejectLargeValues is set.
+var ErrValueTooLarge = errors.New("value too large")
+
 // KeyPrefix is prepended to all tested keys.
 // If changed, it must not contain a forward slash (/)
 var KeyPrefix = "__test__key__"
 
+// StreamingLister is implemented by Storages that can return the keys
+// of a List incrementally. ListStream calls f with each key List would return,
+// and stops with the error f returns, if any.
+type StreamingLister interface {
+	ListStream(ctx context.Context, path string, recursive bool, f func(key string) error) error
+}
+
 // Suite implements tests for certmagic.Storage.
 //
 // Users should call Suite.Run() in their storage_test.go file.
@@ -43,6 +82,233 @@ type Suite struct {
 	S   certmagic.Storage
 	Rng interface{ Int() int }
 
+	// Warmup is the number of throwaway Store/Load/Delete cycles
+	// performed before timing-sensitive tests and benchmarks,
+	// e.g. to establish connections of network backends.
+	Warmup int
+
+	// Close, if set, closes the Storage.
+	// It's called by the last test, which checks that operations
+	// interrupted by or following it fail instead of panicking or hanging.
+	Close func()
+
+	// ResourceCheck, if set, returns a measure of the resources held by
+	// the Storage, e.g. its number of open file descriptors or connections.
+	// It must not grow while the same lock is repeatedly acquired and released.
+	ResourceCheck func() int
+
+	// RejectDirDelete is true if Delete of a directory key fails and leaves
+	// the keys inside it intact. By default, it must delete all of them,
+	// as required by certmagic.Storage and implemented by certmagic.FileStorage.
+	RejectDirDelete bool
+
+	// LargeListSize is the number of keys stored in a directory to check
+	// that List returns all of them, and defaults to DefaultLargeListSize.
+	LargeListSize int
+
+	// MaxDeleteDuration, if set, is the longest Delete of one of
+	// LargeListSize keys in a directory may take, to catch Deletes scanning all keys.
+	MaxDeleteDuration time.Duration
+
+	// MaxKeyDepth is the number of segments of the deepest key that must
+	// round-trip and be listed at each level, and defaults to DefaultMaxKeyDepth.
+	MaxKeyDepth int
+
+	// AllowDirLoad is true if Load of a directory key may succeed,
+	// for backends that store a value for directories.
+	// By default, it must fail like it does for certmagic.FileStorage.
+	AllowDirLoad bool
+
+	// MaxValueSize, if set, is the largest value size supported by the Storage.
+	// Values of that size must round-trip, and larger values must either
+	// round-trip as well or fail to be stored, but never be truncated.
+	MaxValueSize int
+
+	// RejectLargeValues is true if MaxValueSize is a hard limit:
+	// Store of larger values must fail, preferably with an error wrapping ErrValueTooLarge.
+	RejectLargeValues bool
+
+	// StrategyBoundary, if set, is the value size at which the Storage
+	// switches how it stores values, e.g. from inline to external objects.
+	// Values one byte smaller, of that size and one byte larger must round-trip.
+	StrategyBoundary int
+
+	// FrameSize, if set, is the size of the messages the Storage sends
+	// to its backend, e.g. the 4MB limit of gRPC. Values one byte smaller,
+	// of that size and one byte larger must round-trip or fail to be stored,
+	// but never be truncated.
+	FrameSize int
+
+	// LockKeyFor, if set, returns the key under which the Storage keeps
+	// the lock for name. It must exist while the lock is held, and only then.
+	LockKeyFor func(name string) string
+
+	// ReentrantLock is true if a goroutine holding a lock can Lock it again,
+	// and must Unlock it as many times. By default, the second Lock must
+	// block until its context is done, like it does for certmagic.FileStorage.
+	ReentrantLock bool
+
+	// KeepsEmptyDirs is true if a directory still exists after its last
+	// key is deleted, like for certmagic.FileStorage.
+	KeepsEmptyDirs bool
+
+	// EmptyDirReturnsEmptySlice is true if List of an empty directory,
+	// kept by a Storage with KeepsEmptyDirs, returns an empty slice instead of nil.
+	EmptyDirReturnsEmptySlice bool
+
+	// RejectTrailingSlash is true if List of a prefix with a trailing slash fails.
+	// By default, it must return the same keys as List of the prefix without it,
+	// like it does for certmagic.FileStorage.
+	RejectTrailingSlash bool
+
+	// RejectEmptyPrefix is true if List of the empty prefix fails.
+	// By default, it must list the keys at the root of the Storage,
+	// like it does for certmagic.FileStorage.
+	RejectEmptyPrefix bool
+
+	// DualKeys is true if a key can have both a value and children,
+	// whether the value is stored before or after them.
+	// Such a key must be Listed like a directory, while Stat reports it
+	// as terminal and Load returns its value.
+	// By default, storing a key under a terminal key, or a value at a directory key,
+	// must fail like it does for certmagic.FileStorage.
+	DualKeys bool
+
+	// CaseInsensitiveKeys is true if keys differing only in case are the same key,
+	// like for certmagic.FileStorage on the default filesystems of macOS and Windows.
+	// Tests then skip keys differing from another one only in case.
+	CaseInsensitiveKeys bool
+
+	// WindowsFileNames is true if key segments must be valid Windows file names,
+	// like for certmagic.FileStorage on Windows. Tests then skip keys containing
+	// a control character or any of \ : * ? " < > |, or ending with a space or dot.
+	WindowsFileNames bool
+
+	// NormalizesKeys is true if keys in different Unicode normalization forms
+	// are the same key, like for certmagic.FileStorage on macOS.
+	NormalizesKeys bool
+
+	// SkipsIdenticalStores is true if storing the value a key already holds
+	// leaves its Modified time unchanged.
+	// By default, Modified must not go back.
+	SkipsIdenticalStores bool
+
+	// ModifiedAdvances is true if each Store of a key advances its Modified time,
+	// even within the same second, like it does for certmagic.FileStorage.
+	// By default, it may stay the same, as with backends keeping it to the second.
+	ModifiedAdvances bool
+
+	// Sync, if set, flushes buffered writes of the Storage to durable storage.
+	Sync func() error
+
+	// RebuildIndex, if set, rebuilds the index the Storage keeps of its keys,
+	// e.g. the materialized List index of a search-backed Storage.
+	// Keys stored before the rebuild must still be listed and loaded.
+	RebuildIndex func() error
+
+	// Reopen, if set, returns a new instance of the Storage
+	// using the same underlying data, e.g. a new connection to the same database.
+	// Keys stored before reopening must be loaded by the new instance,
+	// like after a restart of the process.
+	Reopen func() certmagic.Storage
+
+	// Fresh, if set, returns a new instance of the Storage on an empty backend,
+	// e.g. a new database, to test the first operations ever performed on it.
+	Fresh func() certmagic.Storage
+
+	// Clients, if set, are independent clients of the same backend as S.
+	// Keys stored through each of them must be visible through all the others.
+	Clients []certmagic.Storage
+
+	// ListEventuallyConsistent is true if List may not reflect a Store
+	// or Delete right away. During Run, each Store and Delete of S then waits
+	// until List of its parent reflects it, for up to consistencyTimeout,
+	// and the Lists of other clients are retried.
+	ListEventuallyConsistent bool
+
+	// ExistsEventuallyConsistent is true if Exists may not reflect a Store
+	// or Delete right away. During Run, each Store and Delete of S then waits
+	// until Exists reflects it, for up to consistencyTimeout,
+	// and the Exists of other clients are retried.
+	ExistsEventuallyConsistent bool
+
+	// AsyncWrites is true if Store and Delete may return before their effect
+	// is visible to Load, Stat, Exists and List. During Run, each Store and Delete
+	// of S then waits until its effect is visible, for up to consistencyTimeout,
+	// and the checks of other clients are retried. By default, they must see it right away.
+	AsyncWrites bool
+
+	// OwnedLocks is true if a client can't release a lock held by another
+	// of the Clients. Unlock of such a lock must fail, or leave it held.
+	// certmagic.FileStorage releases the lock of any instance.
+	OwnedLocks bool
+
+	// Crash, if set, simulates a crash of one of the Clients: it must leave
+	// the locks it holds behind, e.g. stop refreshing them and drop its
+	// connections without unlocking them. The client isn't used afterwards.
+	Crash func(s certmagic.Storage)
+
+	// LockLease is how long a lock left behind by a Crash may stay held,
+	// before another client can acquire it.
+	LockLease time.Duration
+
+	// Concurrency is the number of goroutines used by concurrency tests,
+	// and defaults to DefaultConcurrency.
+	Concurrency int
+
+	// LargeValueSize is the size of the value that must be returned
+	// complete by a single Load, and defaults to DefaultLargeValueSize.
+	LargeValueSize int
+
+	// ChecksumBytes is the total size of the values whose checksums must
+	// match after they're stored and loaded back, and defaults to DefaultChecksumBytes.
+	ChecksumBytes int
+
+	// OverwriteValueSize is the size of the values of a key repeatedly
+	// overwritten while it's loaded, and defaults to DefaultOverwriteValueSize.
+	// It should exceed the chunk size of backends splitting values.
+	OverwriteValueSize int
+
+	// Mix is the mix of operations of BenchmarkMixed, and defaults to DefaultMix.
+	Mix Mix
+
+	// ListIsSorted is true if List returns keys in lexical order.
+	ListIsSorted bool
+
+	// CheckGoroutineLeaks is true if Run fails when the number of goroutines
+	// doesn't settle back to what it was before the tests.
+	CheckGoroutineLeaks bool
+
+	// UsedBytes, if set, returns the storage space used by the Storage.
+	// It must grow when a value is stored, and shrink back when it's deleted.
+	UsedBytes func() int64
+
+	// CheckLockFairness is true if Run checks that goroutines contending
+	// for the same lock all get to acquire it.
+	// Polling lockers like certmagic.FileStorage usually starve some of them.
+	CheckLockFairness bool
+
+	// LockFairnessRatio is the minimum ratio of the fewest to the most
+	// acquisitions of a lock by contending goroutines checked by CheckLockFairness.
+	// If zero, each goroutine must acquire the lock at least once.
+	LockFairnessRatio float64
+
+	// Profile is true if Run logs the latency distribution of each operation.
+	Profile bool
+
+	// Latency, if set, is added to each operation of S during Run,
+	// to check that timing-sensitive tests leave enough margin for slow backends.
+	Latency time.Duration
+
+	// ContextDecorator, if set, wraps the context of each operation of S during Run
+	// and its cleanup, e.g. to add the request-scoped values the Storage reads from it.
+	// The storages of Clients, Reopen and Fresh are used as they are.
+	ContextDecorator func(context.Context) context.Context
+
+	// Quick is true if Run skips slow tests of large values,
+	// large directories and behaviour under load.
+	Quick bool
+
 	mu       sync.Mutex
 	randKeys []string
 }
@@ -53,17 +319,161 @@ type Suite struct {
 //
 //	Test failure line numbers will be reported on files inside this package.
 func (ts *Suite) Run(t *testing.T) {
+	ts.checkStorage(t)
+	defer ts.recoverPanic(t)
+	goroutines := runtime.NumGoroutine()
+	if ts.ContextDecorator != nil {
+		cs := newContextStorage(ts.S, ts.ContextDecorator)
+		ts.S = cs
+		defer func() { ts.S = cs.Storage }()
+	}
+	// cleanup runs after Run restores S, so it keeps the decorated storage
+	sto := ts.S
 	t.Cleanup(func() {
-		ts.mu.Lock()
-		defer ts.mu.Unlock()
+		// t.Context() is already cancelled when cleanup functions run
+		ts.cleanup(context.Background(), sto)
+	})
+	if ts.eventuallyConsistent() {
+		cs := newConsistentStorage(ts.S, ts)
+		ts.S = cs
+		defer func() { ts.S = cs.Storage }()
+	}
+	ts.warmup(t)
+	if ts.Latency > 0 {
+		ls := newLatencyStorage(ts.S, ts.Latency)
+		ts.S = ls
+		defer func() { ts.S = ls.Storage }()
+	}
+	if ts.Profile {
+		ps := newProfiledStorage(ts.S)
+		ts.S = ps
+		defer func() {
+			ts.S = ps.Storage
+			t.Logf("Storage latencies:\n%s", ps.report())
+		}()
+	}
+	ts.run(t, "Locker", false, ts.testLocker)
+	ts.run(t, "LockerEmptyKey", false, ts.testLockerEmptyKey)
+	ts.run(t, "LockerChurn", true, ts.testLockerChurn)
+	ts.run(t, "LockerKey", false, ts.testLockerKey)
+	ts.run(t, "LockerDistinctKeys", true, ts.testLockerDistinctKeys)
+	ts.run(t, "LockerFairness", true, ts.testLockerFairness)
+	ts.run(t, "LockerWithStorage", false, ts.testLockerWithStorage)
+	ts.run(t, "LockerProtectsStore", false, ts.testLockerProtectsStore)
+	ts.run(t, "LockerBeforeStore", false, ts.testLockerBeforeStore)
+	ts.run(t, "LockerDuringDelete", false, ts.testLockerDuringDelete)
+	ts.run(t, "LockerReentrant", false, ts.testLockerReentrant)
+	ts.run(t, "LockerDoubleUnlock", false, ts.testLockerDoubleUnlock)
+	ts.run(t, "StorageSingleKey", false, ts.testStorageSingleKey)
+	ts.run(t, "StorageStatFresh", false, ts.testStorageStatFresh)
+	ts.run(t, "StorageDir", false, ts.testStorageDir)
+	ts.run(t, "StorageDeepKey", false, ts.testStorageDeepKey)
+	ts.run(t, "ListOnlyDirs", false, ts.testListOnlyDirs)
+	ts.run(t, "ListDeepChain", false, ts.testListDeepChain)
+	ts.run(t, "ListStat", false, ts.testListStat)
+	ts.run(t, "ListSelfSimilar", false, ts.testListSelfSimilar)
+	ts.run(t, "ListStreamDeletes", false, ts.testListStreamDeletes)
+	ts.run(t, "ListIndependentSlices", false, ts.testListIndependentSlices)
+	ts.run(t, "ListTrailingSlash", false, ts.testListTrailingSlash)
+	ts.run(t, "ListRoot", false, ts.testListRoot)
+	ts.run(t, "StorageKeyDepth", false, ts.testStorageKeyDepth)
+	ts.run(t, "StorageDirExists", false, ts.testStorageDirExists)
+	ts.run(t, "ListEmptyDir", false, ts.testListEmptyDir)
+	ts.run(t, "StorageDirChurn", false, ts.testStorageDirChurn)
+	ts.run(t, "StorageOverwrite", false, ts.testStorageOverwrite)
+	ts.run(t, "StorageModifiedOnRead", false, ts.testStorageModifiedOnRead)
+	ts.run(t, "StorageIdenticalStores", false, ts.testStorageIdenticalStores)
+	ts.run(t, "StorageReadAfterWrite", false, ts.testStorageReadAfterWrite)
+	ts.run(t, "StorageConsistency", false, ts.testStorageConsistency)
+	ts.run(t, "StorageBatchExists", false, ts.testStorageBatchExists)
+	ts.run(t, "StorageShrinkSize", false, ts.testStorageShrinkSize)
+	ts.run(t, "StorageBinaryValues", false, ts.testStorageBinaryValues)
+	ts.run(t, "StorageEmptyValue", false, ts.testStorageEmptyValue)
+	ts.run(t, "StorageSingleByte", false, ts.testStorageSingleByte)
+	ts.run(t, "StorageTrailingNuls", false, ts.testStorageTrailingNuls)
+	ts.run(t, "StorageKeyInValue", false, ts.testStorageKeyInValue)
+	ts.run(t, "StorageMutatedValue", false, ts.testStorageMutatedValue)
+	ts.run(t, "StoragePrintableKeys", false, ts.testStoragePrintableKeys)
+	ts.run(t, "StorageDeleteDir", false, ts.testStorageDeleteDir)
+	ts.run(t, "StorageKeyCollisions", false, ts.testStorageKeyCollisions)
+	ts.run(t, "StorageWhitespaceKeys", false, ts.testStorageWhitespaceKeys)
+	ts.run(t, "StorageURLKeys", false, ts.testStorageURLKeys)
+	ts.run(t, "StorageKeyPrefixInKeys", false, ts.testStorageKeyPrefixInKeys)
+	ts.run(t, "StorageKeyPrefixDir", false, ts.testStorageKeyPrefixDir)
+	ts.run(t, "StorageNulKey", false, ts.testStorageNulKey)
+	ts.run(t, "StorageAstralKeys", false, ts.testStorageAstralKeys)
+	ts.run(t, "ListUnicodeNormalization", false, ts.testListUnicodeNormalization)
+	ts.run(t, "ListLarge", true, ts.testListLarge)
+	ts.run(t, "DeleteLarge", true, ts.testDeleteLarge)
+	ts.run(t, "ListCancelled", true, ts.testListCancelled)
+	ts.run(t, "StorageMaxValueSize", true, ts.testStorageMaxValueSize)
+	ts.run(t, "StorageStrategyBoundary", false, ts.testStorageStrategyBoundary)
+	ts.run(t, "StorageFrameSize", false, ts.testStorageFrameSize)
+	ts.run(t, "StorageLargeValue", true, ts.testStorageLargeValue)
+	ts.run(t, "StorageChecksums", true, ts.testStorageChecksums)
+	ts.run(t, "StorageBufferSizes", false, ts.testStorageBufferSizes)
+	ts.run(t, "StorageSync", false, ts.testStorageSync)
+	ts.run(t, "StorageRebuildIndex", false, ts.testStorageRebuildIndex)
+	ts.run(t, "StorageReopen", false, ts.testStorageReopen)
+	ts.run(t, "StorageFresh", false, ts.testStorageFresh)
+	ts.run(t, "StorageColdLoad", false, ts.testStorageColdLoad)
+	ts.run(t, "StorageUsedBytes", true, ts.testStorageUsedBytes)
+	ts.run(t, "StorageDualKey", false, ts.testStorageDualKey)
+	ts.run(t, "Clients", false, ts.testClients)
+	ts.run(t, "ClientsRenewal", false, ts.testClientsRenewal)
+	ts.run(t, "ClientsOwnedLocks", false, ts.testClientsOwnedLocks)
+	ts.run(t, "ClientsCrash", true, ts.testClientsCrash)
+	ts.run(t, "ConcurrentStores", true, ts.testConcurrentStores)
+	ts.run(t, "LoadDuringOverwrites", true, ts.testLoadDuringOverwrites)
+	ts.run(t, "ConcurrentDirCreation", false, ts.testConcurrentDirCreation)
+	ts.run(t, "ConcurrentDeletes", false, ts.testConcurrentDeletes)
+	ts.run(t, "ConcurrentDistinctDirs", false, ts.testConcurrentDistinctDirs)
+	ts.run(t, "StatDuringStores", true, ts.testStatDuringStores)
+	ts.run(t, "StatDuringDeletes", true, ts.testStatDuringDeletes)
+	ts.run(t, "ListDuringStores", true, ts.testListDuringStores)
+	ts.run(t, "ListDuringLocks", true, ts.testListDuringLocks)
+	ts.run(t, "Replay", false, func(t *testing.T) { ts.replay(t, CertmagicTrace) })
+	ts.run(t, "Close", false, ts.testClose)
+	ts.checkGoroutineLeaks(t, goroutines)
+}
 
-		for _, k := range ts.randKeys {
-			ts.S.Delete(t.Context(), k)
+// run runs f as a subtest called name, skipping it in Quick mode if slow is true
+func (ts *Suite) run(t *testing.T, name string, slow bool, f func(t *testing.T)) {
+	t.Run(name, func(t *testing.T) {
+		if slow && ts.Quick {
+			t.Skip("slow test skipped in Quick mode")
 		}
+		defer ts.recoverPanic(t)
+		f(t)
 	})
-	ts.testLocker(t)
-	ts.testStorageSingleKey(t)
-	ts.testStorageDir(t)
+}
+
+// goroutineLeakTimeout is how long checkGoroutineLeaks waits for goroutines to exit.
+// certmagic.FileStorage keeps a goroutine refreshing each lock for up to 5s after it's released.
+const goroutineLeakTimeout = 10 * time.Second
+
+// goroutineLeakTolerance is the number of extra goroutines checkGoroutineLeaks tolerates
+const goroutineLeakTolerance = 2
+
+// checkGoroutineLeaks fails the test if ts.CheckGoroutineLeaks is true and the number
+// of goroutines doesn't settle back to at most n (plus a tolerance)
+func (ts *Suite) checkGoroutineLeaks(t *testing.T, n int) {
+	if !ts.CheckGoroutineLeaks {
+		return
+	}
+	deadline := time.Now().Add(goroutineLeakTimeout)
+	for {
+		leaked := runtime.NumGoroutine() - n
+		if leaked <= goroutineLeakTolerance {
+			return
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("%d goroutines leaked, still running after %s:\n%s", leaked, goroutineLeakTimeout, buf)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
 }
 
 func (ts *Suite) testLocker(t *testing.T) {
@@ -78,12 +488,14 @@ func (ts *Suite) testLocker(t *testing.T) {
 		t.Fatalf("Storage fails to unlock locked key: %s", err)
 	}
 
+	var acquired atomic.Int64
 	test := func(key string) {
 		for i := 0; i < 5; i++ {
 			if err := ts.S.Lock(t.Context(), key); err != nil {
 				// certmagic lockers can timeout
 				continue
 			}
+			acquired.Add(1)
 			runtime.Gosched()
 			if err := ts.S.Unlock(t.Context(), key); err != nil {
 				t.Fatalf("Storage.Unlock failed: %s", err)
@@ -97,11 +509,439 @@ func (ts *Suite) testLocker(t *testing.T) {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
+				defer ts.recoverPanic(t)
 				test(key)
 			}()
 		}
 	}
 	wg.Wait()
+	// timeouts are fine, as long as they're not all the Lock calls do
+	if acquired.Load() == 0 {
+		t.Fatalf("Storage fails to lock keys contended by concurrent goroutines: all Lock calls failed")
+	}
+}
+
+func (ts *Suite) testLockerEmptyKey(t *testing.T) {
+	// Backends may reject an empty lock name, but if they accept it,
+	// it must behave like any other named lock and not a global one.
+	if err := ts.S.Lock(t.Context(), ""); err != nil {
+		if err := ts.S.Unlock(t.Context(), ""); err == nil {
+			t.Fatalf("Storage successfully unlocks empty key it failed to lock")
+		}
+		return
+	}
+
+	key := strconv.Itoa(ts.Rng.Int())
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	if err := ts.S.Lock(ctx, key); err != nil {
+		ts.S.Unlock(t.Context(), "")
+		t.Fatalf("Storage fails to lock key %s while empty key is locked: %s", key, err)
+	}
+	if err := ts.S.Unlock(t.Context(), key); err != nil {
+		t.Fatalf("Storage fails to unlock locked key: %s", err)
+	}
+
+	if err := ts.S.Unlock(t.Context(), ""); err != nil {
+		t.Fatalf("Storage locks empty key but fails to unlock it: %s", err)
+	}
+	if err := ts.S.Unlock(t.Context(), ""); err == nil {
+		t.Fatalf("Storage successfully unlocks unlocked empty key")
+	}
+}
+
+func (ts *Suite) testLockerChurn(t *testing.T) {
+	const cycles = 2000
+	key := strconv.Itoa(ts.Rng.Int())
+	check := ts.ResourceCheck
+	if check == nil {
+		check = func() int { return 0 }
+	}
+
+	baseline := 0
+	for i := 0; i < cycles; i++ {
+		if i == cycles/10 {
+			// measure after connection pools etc. were filled
+			baseline = check()
+		}
+		if err := ts.S.Lock(t.Context(), key); err != nil {
+			t.Fatalf("Storage fails to lock key after %d lock/unlock cycles: %s", i, err)
+		}
+		if err := ts.S.Unlock(t.Context(), key); err != nil {
+			t.Fatalf("Storage fails to unlock locked key after %d lock/unlock cycles: %s", i, err)
+		}
+	}
+	if n := check(); n-baseline > cycles/100 {
+		t.Fatalf("ResourceCheck grew from %d to %d during %d lock/unlock cycles", baseline, n, cycles)
+	}
+}
+
+func (ts *Suite) testLockerKey(t *testing.T) {
+	if ts.LockKeyFor == nil {
+		return
+	}
+	name := strconv.Itoa(ts.Rng.Int())
+	key := ts.LockKeyFor(name)
+
+	if ts.S.Exists(t.Context(), key) {
+		t.Fatalf("Lock key %s exists before Lock(%s)", key, name)
+	}
+	if err := ts.S.Lock(t.Context(), name); err != nil {
+		t.Fatalf("Storage fails to lock key: %s", err)
+	}
+	if !ts.S.Exists(t.Context(), key) {
+		ts.S.Unlock(t.Context(), name)
+		t.Fatalf("Lock key %s doesn't exist after Lock(%s)", key, name)
+	}
+	if err := ts.S.Unlock(t.Context(), name); err != nil {
+		t.Fatalf("Storage fails to unlock locked key: %s", err)
+	}
+	if ts.S.Exists(t.Context(), key) {
+		t.Fatalf("Lock key %s still exists after Unlock(%s)", key, name)
+	}
+}
+
+func (ts *Suite) testLockerDistinctKeys(t *testing.T) {
+	wg := &sync.WaitGroup{}
+	for i := 0; i < ts.concurrency(); i++ {
+		key := ts.randKey()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer ts.recoverPanic(t)
+			for j := 0; j < 50; j++ {
+				if err := ts.S.Lock(t.Context(), key); err != nil {
+					t.Errorf("Storage fails to lock key %s after %d lock/unlock cycles: %s", key, j, err)
+					return
+				}
+				if err := ts.S.Unlock(t.Context(), key); err != nil {
+					t.Errorf("Storage fails to unlock locked key %s after %d lock/unlock cycles: %s", key, j, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+}
+
+// lockFairnessDuration is how long testLockerFairness contends for a lock
+const lockFairnessDuration = 5 * time.Second
+
+func (ts *Suite) testLockerFairness(t *testing.T) {
+	if !ts.CheckLockFairness {
+		return
+	}
+	key := strconv.Itoa(ts.Rng.Int())
+	ctx, cancel := context.WithTimeout(t.Context(), lockFairnessDuration)
+	defer cancel()
+
+	counts := make([]int, ts.concurrency())
+	wg := &sync.WaitGroup{}
+	for i := range counts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer ts.recoverPanic(t)
+			for ctx.Err() == nil {
+				if err := ts.S.Lock(ctx, key); err != nil {
+					// the context expired while waiting
+					continue
+				}
+				counts[i]++
+				time.Sleep(time.Millisecond)
+				if err := ts.S.Unlock(t.Context(), key); err != nil {
+					t.Errorf("Storage.Unlock failed: %s", err)
+					return
+				}
+				runtime.Gosched()
+			}
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	least, most := slices.Min(counts), slices.Max(counts)
+	switch {
+	case least == 0:
+		t.Fatalf("Lock(%s) starved goroutines contending for it for %s: acquisitions per goroutine: %v", key, lockFairnessDuration, counts)
+	case float64(least)/float64(most) < ts.LockFairnessRatio:
+		t.Fatalf("Lock(%s) is unfair to goroutines contending for it for %s: acquisitions per goroutine: %v, ratio of fewest to most is %.2f, but should be at least %.2f",
+			key, lockFairnessDuration, counts, float64(least)/float64(most), ts.LockFairnessRatio)
+	}
+}
+
+func (ts *Suite) testLockerWithStorage(t *testing.T) {
+	sto := ts.S
+	key := ts.randKey()
+	ts.addCleanupKeys(key)
+	val := []byte(key)
+
+	if err := sto.Lock(t.Context(), key); err != nil {
+		t.Fatalf("Storage fails to lock key: %s", err)
+	}
+
+	var stored atomic.Bool
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer ts.recoverPanic(t)
+		if err := sto.Lock(ctx, key); err != nil {
+			t.Errorf("Storage fails to lock key released by another goroutine: %s", err)
+			return
+		}
+		defer func() {
+			if err := sto.Unlock(t.Context(), key); err != nil {
+				t.Errorf("Storage fails to unlock locked key: %s", err)
+			}
+		}()
+		if !stored.Load() {
+			t.Errorf("Storage locks key %s still locked by another goroutine", key)
+			return
+		}
+		switch s, err := sto.Load(t.Context(), key); {
+		case err != nil:
+			t.Errorf("Load(%s) failed after acquiring lock: %s", key, err)
+		case !bytes.Equal(val, s):
+			t.Errorf("Load(%s) failed after acquiring lock: loaded %#v != stored %#v", key, s, val)
+		}
+		if err := sto.Delete(t.Context(), key); err != nil {
+			t.Errorf("Delete(%s) failed while locked: %s", key, err)
+		}
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if err := sto.Store(t.Context(), key, val); err != nil {
+		sto.Unlock(t.Context(), key)
+		t.Fatalf("Store(%s) failed while locked: %s", key, err)
+	}
+	switch s, err := sto.Load(t.Context(), key); {
+	case err != nil:
+		t.Errorf("Load(%s) failed while locked: %s", key, err)
+	case !bytes.Equal(val, s):
+		t.Errorf("Load(%s) failed while locked: loaded %#v != stored %#v", key, s, val)
+	}
+	stored.Store(true)
+	if err := sto.Unlock(t.Context(), key); err != nil {
+		t.Fatalf("Storage fails to unlock locked key: %s", err)
+	}
+	<-done
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	if sto.Exists(t.Context(), key) {
+		t.Fatalf("Deleted key still %s exists", key)
+	}
+}
+
+func (ts *Suite) testLockerReentrant(t *testing.T) {
+	sto := ts.S
+	key := strconv.Itoa(ts.Rng.Int())
+
+	if err := sto.Lock(t.Context(), key); err != nil {
+		t.Fatalf("Storage fails to lock key: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	err := catchPanic(func() error { return sto.Lock(ctx, key) })
+	switch {
+	case errors.Is(err, errPanic):
+		sto.Unlock(t.Context(), key)
+		t.Fatalf("Storage fails to lock key again from the same goroutine: %s", err)
+	case ts.ReentrantLock && err != nil:
+		sto.Unlock(t.Context(), key)
+		t.Fatalf("Storage fails to lock key again from the same goroutine: %s", err)
+	case !ts.ReentrantLock && err == nil:
+		sto.Unlock(t.Context(), key)
+		t.Fatalf("Storage locks key %s again from the same goroutine, but ReentrantLock is false", key)
+	case ts.ReentrantLock:
+		if err := sto.Unlock(t.Context(), key); err != nil {
+			t.Fatalf("Storage fails to unlock re-entered lock: %s", err)
+		}
+	}
+	if err := sto.Unlock(t.Context(), key); err != nil {
+		t.Fatalf("Storage fails to unlock locked key: %s", err)
+	}
+
+	// the failed or re-entered Lock must not leave the key locked
+	ctx, cancel = context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	if err := sto.Lock(ctx, key); err != nil {
+		t.Fatalf("Storage fails to lock key unlocked after locking it again: %s", err)
+	}
+	if err := sto.Unlock(t.Context(), key); err != nil {
+		t.Fatalf("Storage fails to unlock locked key: %s", err)
+	}
+}
+
+// testLockerDoubleUnlock checks a second Unlock, like an explicit Unlock
+// followed by a deferred one, fails without corrupting the lock
+func (ts *Suite) testLockerDoubleUnlock(t *testing.T) {
+	sto := ts.S
+	key := strconv.Itoa(ts.Rng.Int())
+
+	if err := sto.Lock(t.Context(), key); err != nil {
+		t.Fatalf("Storage fails to lock key: %s", err)
+	}
+	if err := sto.Unlock(t.Context(), key); err != nil {
+		t.Fatalf("Storage fails to unlock locked key: %s", err)
+	}
+	if err := sto.Unlock(t.Context(), key); err == nil {
+		t.Fatalf("Storage successfully unlocks key that was already unlocked")
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	if err := sto.Lock(ctx, key); err != nil {
+		t.Fatalf("Storage fails to lock key after a second Unlock: %s", err)
+	}
+	if err := sto.Unlock(t.Context(), key); err != nil {
+		t.Fatalf("Storage fails to unlock locked key after a second Unlock: %s", err)
+	}
+}
+
+// testLockerBeforeStore checks that a key doesn't need to be stored to be locked,
+// like when certmagic locks a certificate before obtaining it
+func (ts *Suite) testLockerBeforeStore(t *testing.T) {
+	sto := ts.S
+	key := ts.randKey()
+	ts.addCleanupKeys(key)
+	val := []byte(key)
+
+	if err := sto.Lock(t.Context(), key); err != nil {
+		t.Fatalf("Storage fails to lock never stored key: %s", err)
+	}
+	if err := sto.Store(t.Context(), key, val); err != nil {
+		sto.Unlock(t.Context(), key)
+		t.Fatalf("Store(%s) failed while locked: %s", key, err)
+	}
+	switch s, err := sto.Load(t.Context(), key); {
+	case err != nil:
+		sto.Unlock(t.Context(), key)
+		t.Fatalf("Load(%s) failed while locked: %s", key, err)
+	case !bytes.Equal(val, s):
+		sto.Unlock(t.Context(), key)
+		t.Fatalf("Load(%s) failed while locked: loaded %#v != stored %#v", key, string(s), string(val))
+	}
+	if err := sto.Unlock(t.Context(), key); err != nil {
+		t.Fatalf("Storage fails to unlock key locked before it was stored: %s", err)
+	}
+}
+
+// testLockerDuringDelete checks a key can be deleted while it is locked,
+// like certmagic cleaning up expired certificates
+func (ts *Suite) testLockerDuringDelete(t *testing.T) {
+	sto := ts.S
+	key := ts.randKey()
+	ts.addCleanupKeys(key)
+
+	if err := sto.Store(t.Context(), key, []byte(key)); err != nil {
+		t.Fatalf("Store(%s) failed: %s", key, err)
+	}
+	if err := sto.Lock(t.Context(), key); err != nil {
+		t.Fatalf("Storage fails to lock key: %s", err)
+	}
+	if err := sto.Delete(t.Context(), key); err != nil {
+		sto.Unlock(t.Context(), key)
+		t.Fatalf("Delete(%s) failed while locked: %s", key, err)
+	}
+	if !ts.eventually(ts.ExistsEventuallyConsistent, func() bool { return !sto.Exists(t.Context(), key) }) {
+		sto.Unlock(t.Context(), key)
+		t.Fatalf("Key %s exists after it was deleted while locked", key)
+	}
+	if err := sto.Unlock(t.Context(), key); err != nil {
+		t.Fatalf("Storage fails to unlock key deleted while locked: %s", err)
+	}
+
+	// the lock must not be left behind by the Delete
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+	defer cancel()
+	if err := sto.Lock(ctx, key); err != nil {
+		t.Fatalf("Storage fails to lock key unlocked after Delete(%s): %s", key, err)
+	}
+	if err := sto.Unlock(t.Context(), key); err != nil {
+		t.Fatalf("Storage fails to unlock key: %s", err)
+	}
+}
+
+func (ts *Suite) testLockerProtectsStore(t *testing.T) {
+	sto := ts.S
+	key := ts.randKey()
+	ts.addCleanupKeys(key)
+	valA := []byte("value A")
+	valB := []byte("value B")
+
+	if err := sto.Lock(t.Context(), key); err != nil {
+		t.Fatalf("Storage fails to lock key: %s", err)
+	}
+	if err := sto.Store(t.Context(), key, valA); err != nil {
+		sto.Unlock(t.Context(), key)
+		t.Fatalf("Store(%s) failed while locked: %s", key, err)
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	if err := sto.Lock(ctx, key); err == nil {
+		sto.Unlock(t.Context(), key)
+		if !ts.ReentrantLock {
+			t.Fatalf("Storage locks key %s that is already locked", key)
+		}
+	}
+
+	ctx, cancel = context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer ts.recoverPanic(t)
+		if err := sto.Lock(ctx, key); err != nil {
+			t.Errorf("Storage fails to lock key released by another goroutine: %s", err)
+			return
+		}
+		defer func() {
+			if err := sto.Unlock(t.Context(), key); err != nil {
+				t.Errorf("Storage fails to unlock locked key: %s", err)
+			}
+		}()
+		if err := sto.Store(t.Context(), key, valB); err != nil {
+			t.Errorf("Store(%s) failed while locked: %s", key, err)
+		}
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// give the goroutine a chance to Store without the lock
+	time.Sleep(100 * time.Millisecond)
+	switch s, err := sto.Load(t.Context(), key); {
+	case err != nil:
+		t.Errorf("Load(%s) failed while locked: %s", key, err)
+	case !bytes.Equal(valA, s):
+		t.Errorf("Load(%s) failed while locked: loaded %#v != stored %#v", key, string(s), string(valA))
+	}
+	if err := sto.Unlock(t.Context(), key); err != nil {
+		t.Fatalf("Storage fails to unlock locked key: %s", err)
+	}
+	<-done
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	switch s, err := sto.Load(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Load(%s) failed: %s", key, err)
+	case !bytes.Equal(valB, s):
+		t.Fatalf("Load(%s) failed: loaded %#v, but value stored after acquiring the lock was %#v", key, string(s), string(valB))
+	}
 }
 
 func (ts *Suite) testStorageSingleKey(t *testing.T) {
@@ -159,6 +999,38 @@ func (ts *Suite) testStorageSingleKey(t *testing.T) {
 	}
 }
 
+// statClockSkew is how far the Modified time of a fresh key may be
+// from the local clock, for backends setting it on a remote server
+const statClockSkew = time.Minute
+
+func (ts *Suite) testStorageStatFresh(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	// a new directory, so no index of its contents was built by a previous List
+	key := dir + "/sub/k"
+	val := []byte(key)
+
+	start := time.Now()
+	if err := sto.Store(t.Context(), key, val); err != nil {
+		t.Fatalf("Store(%s) failed: %s", key, err)
+	}
+	end := time.Now()
+
+	switch inf, err := sto.Stat(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Stat(%s) of a freshly stored key failed: %s", key, err)
+	case inf.Key != key:
+		t.Fatalf("Stat(%s) failed: Key is set to %#v", key, inf.Key)
+	case !inf.IsTerminal:
+		t.Fatalf("Stat(%s) failed: IsTerminal should be true for non-directory keys", key)
+	case inf.Size != 0 && inf.Size != int64(len(val)):
+		t.Fatalf("Stat(%s) failed: Size is %d, but should be %d", key, inf.Size, len(val))
+	case !inf.Modified.IsZero() && (inf.Modified.Before(start.Add(-statClockSkew)) || inf.Modified.After(end.Add(statClockSkew))):
+		t.Fatalf("Stat(%s) failed: Modified is %s, but the key was stored between %s and %s", key, inf.Modified, start, end)
+	}
+}
+
 func (ts *Suite) testStorageDir(t *testing.T) {
 	sto := ts.S
 	dir := ts.randKey()
@@ -197,6 +1069,10 @@ func (ts *Suite) testStorageDir(t *testing.T) {
 		t.Fatalf("Stat(%s) failed: IsTerminal should be false for directory keys", dir)
 	}
 
+	if _, err := sto.Load(t.Context(), dir); err == nil && !ts.AllowDirLoad {
+		t.Fatalf("Load(%s) should fail: the key is a directory", dir)
+	}
+
 	switch inf, err := sto.Stat(t.Context(), k2); {
 	case err != nil:
 		t.Fatalf("Stat(%s) failed: %s", k2, err)
@@ -209,6 +1085,11 @@ func (ts *Suite) testStorageDir(t *testing.T) {
 	if ls, err := sto.List(t.Context(), dir, false); err != nil {
 		t.Fatalf("List(%s, false) failed: %s", dir, err)
 	} else {
+		if slices.Contains(ls, dir) {
+			t.Fatalf("List(%s, false) failed: the queried prefix should not be listed as its own entry", dir)
+		}
+		ts.checkListPrefix(t, ls, dir, false)
+		ts.checkListSorted(t, ls, dir, false)
 		sort.Strings(ls)
 		got := fmt.Sprintf("%#v", ls)
 		exp := fmt.Sprintf("%#v", []string{dir + "/k", k1})
@@ -220,6 +1101,11 @@ func (ts *Suite) testStorageDir(t *testing.T) {
 	if ls, err := sto.List(t.Context(), dir, true); err != nil {
 		t.Fatalf("List(%s, true) failed: %s", dir, err)
 	} else {
+		if slices.Contains(ls, dir) {
+			t.Fatalf("List(%s, true) failed: the queried prefix should not be listed as its own entry", dir)
+		}
+		ts.checkListPrefix(t, ls, dir, true)
+		ts.checkListSorted(t, ls, dir, true)
 		sort.Strings(ls)
 		got := fmt.Sprintf("%#v", ls)
 		exp := fmt.Sprintf("%#v", []string{
@@ -235,8 +1121,2959 @@ func (ts *Suite) testStorageDir(t *testing.T) {
 	}
 }
 
-func (ts *Suite) randKey() string {
-	return KeyPrefix + strconv.Itoa(ts.Rng.Int())
+func (ts *Suite) testStorageDeepKey(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+
+	// mirrors the shape of the keys certmagic uses for certificates and ACME assets
+	segments := []string{
+		dir,
+		"acme",
+		"acme-v02.api.letsencrypt.org-directory",
+		"sites",
+		"example.com",
+		"a",
+		"b",
+		"c",
+		"example.com.crt",
+	}
+	key := strings.Join(segments, "/")
+	val := []byte(key)
+
+	if err := sto.Store(t.Context(), key, val); err != nil {
+		t.Fatalf("Store(%s) failed: %s", key, err)
+	}
+
+	switch s, err := sto.Load(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Load(%s) failed: %s", key, err)
+	case !bytes.Equal(val, s):
+		t.Fatalf("Load(%s) failed: loaded %#v != stored %#v", key, s, val)
+	}
+
+	for i := 1; i < len(segments); i++ {
+		prefix := strings.Join(segments[:i], "/")
+		switch inf, err := sto.Stat(t.Context(), prefix); {
+		case err != nil:
+			t.Fatalf("Stat(%s) failed: %s", prefix, err)
+		case inf.Key != prefix:
+			t.Fatalf("Stat(%s) failed: Key is set to %#v, but should be %#v", prefix, inf.Key, prefix)
+		case inf.IsTerminal:
+			t.Fatalf("Stat(%s) failed: IsTerminal should be false for directory keys", prefix)
+		}
+	}
+
+	switch inf, err := sto.Stat(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Stat(%s) failed: %s", key, err)
+	case inf.Key != key:
+		t.Fatalf("Stat(%s) failed: Key is set to %#v, but should be %#v", key, inf.Key, key)
+	case !inf.IsTerminal:
+		t.Fatalf("Stat(%s) failed: IsTerminal should be true for non-directory keys", key)
+	}
+
+	if err := sto.Delete(t.Context(), key); err != nil {
+		t.Fatalf("Delete(%s) failed: %s", key, err)
+	}
+
+	if sto.Exists(t.Context(), key) {
+		t.Fatalf("Deleted key still %s exists", key)
+	}
+
+	if _, err := sto.Load(t.Context(), key); err == nil {
+		t.Fatalf("Load(%s) should fail: the key was deleted", key)
+	}
+}
+
+func (ts *Suite) testListOnlyDirs(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	a := dir + "/a"
+	b := dir + "/b"
+
+	for _, k := range []string{a + "/x", b + "/y"} {
+		if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+			t.Fatalf("Store(%s) failed: %s", k, err)
+		}
+	}
+
+	for recursive, keys := range map[bool][]string{
+		false: {a, b},
+		true:  {a, a + "/x", b, b + "/y"},
+	} {
+		ls, err := sto.List(t.Context(), dir, recursive)
+		if err != nil {
+			t.Fatalf("List(%s, %v) of directory without direct leaves failed: %s", dir, recursive, err)
+		}
+		ts.checkListPrefix(t, ls, dir, recursive)
+		ts.checkListSorted(t, ls, dir, recursive)
+		sort.Strings(ls)
+		got := fmt.Sprintf("%#v", ls)
+		exp := fmt.Sprintf("%#v", keys)
+		if got != exp {
+			t.Fatalf("List(%s, %v) of directory without direct leaves failed: it should return %s, not %s", dir, recursive, exp, got)
+		}
+	}
+}
+
+func (ts *Suite) testListDeepChain(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+
+	var chain []string
+	k := dir
+	for _, seg := range []string{"a", "b", "c", "d", "e"} {
+		k += "/" + seg
+		chain = append(chain, k)
+	}
+	leaf := chain[len(chain)-1]
+	if err := sto.Store(t.Context(), leaf, []byte(leaf)); err != nil {
+		t.Fatalf("Store(%s) failed: %s", leaf, err)
+	}
+
+	for recursive, keys := range map[bool][]string{
+		false: chain[:1],
+		true:  chain,
+	} {
+		ls, err := sto.List(t.Context(), dir, recursive)
+		if err != nil {
+			t.Fatalf("List(%s, %v) of a single deep key failed: %s", dir, recursive, err)
+		}
+		ts.checkListPrefix(t, ls, dir, recursive)
+		ts.checkListSorted(t, ls, dir, recursive)
+		sort.Strings(ls)
+		got := fmt.Sprintf("%#v", ls)
+		exp := fmt.Sprintf("%#v", keys)
+		if got != exp {
+			t.Fatalf("List(%s, %v) of a single deep key failed: it should return %s, not %s", dir, recursive, exp, got)
+		}
+	}
+}
+
+// selfSimilarListTimeout is how long testListSelfSimilar waits for a List
+const selfSimilarListTimeout = 10 * time.Second
+
+func (ts *Suite) testListSelfSimilar(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	// segments repeating their parent, or the whole prefix
+	keys := []string{
+		dir + strings.Repeat("/a", 20),
+		dir + "/" + dir + "/" + dir + "/" + dir,
+		dir + "/b/b/" + dir + "/b",
+	}
+
+	exp := map[string]bool{}
+	for _, k := range keys {
+		if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+			t.Fatalf("Store(%s) failed: %s", k, err)
+		}
+		for p := k; p != dir; p = p[:strings.LastIndex(p, "/")] {
+			exp[p] = true
+		}
+	}
+
+	// a List that doesn't terminate may not return when its context is done either
+	type result struct {
+		ls  []string
+		err error
+	}
+	listed := make(chan result, 1)
+	go func() {
+		var ls []string
+		err := catchPanic(func() (err error) {
+			ls, err = sto.List(t.Context(), dir, true)
+			return err
+		})
+		listed <- result{ls, err}
+	}()
+	var ls []string
+	var err error
+	select {
+	case r := <-listed:
+		ls, err = r.ls, r.err
+	case <-time.After(selfSimilarListTimeout):
+		t.Fatalf("List(%s, true) of self-similar keys didn't return after %s", dir, selfSimilarListTimeout)
+	}
+	if err != nil {
+		t.Fatalf("List(%s, true) of self-similar keys failed: %s", dir, err)
+	}
+	if len(ls) != len(exp) {
+		t.Fatalf("List(%s, true) of self-similar keys failed: it returned %d keys, but should return %d", dir, len(ls), len(exp))
+	}
+	ts.checkListSubset(t, ls, dir, true, exp)
+}
+
+func (ts *Suite) testListIndependentSlices(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	keys := []string{dir + "/c", dir + "/a", dir + "/b"}
+	for _, k := range keys {
+		if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+			t.Fatalf("Store(%s) failed: %s", k, err)
+		}
+	}
+	sort.Strings(keys)
+	exp := fmt.Sprintf("%#v", keys)
+
+	results := make([][]string, 2)
+	wg := &sync.WaitGroup{}
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer ts.recoverPanic(t)
+			ls, err := sto.List(t.Context(), dir, false)
+			if err != nil {
+				t.Errorf("List(%s, false) failed during a concurrent List: %s", dir, err)
+			}
+			results[i] = ls
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	// like a caller sorting and reusing its result
+	sort.Sort(sort.Reverse(sort.StringSlice(results[0])))
+	for i := range results[0] {
+		results[0][i] = "mutated"
+	}
+	ls, err := sto.List(t.Context(), dir, false)
+	if err != nil {
+		t.Fatalf("List(%s, false) failed: %s", dir, err)
+	}
+	for _, ls := range [][]string{results[1], ls} {
+		ls = slices.Clone(ls)
+		sort.Strings(ls)
+		if got := fmt.Sprintf("%#v", ls); got != exp {
+			t.Fatalf("List(%s, false) failed: it returned %s after the result of another List was modified, instead of %s", dir, got, exp)
+		}
+	}
+}
+
+func (ts *Suite) testListTrailingSlash(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	keys := []string{dir + "/a", dir + "/b/c"}
+	for _, k := range keys {
+		if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+			t.Fatalf("Store(%s) failed: %s", k, err)
+		}
+	}
+
+	for _, recursive := range []bool{false, true} {
+		exp, err := sto.List(t.Context(), dir, recursive)
+		if err != nil {
+			t.Fatalf("List(%s, %v) failed: %s", dir, recursive, err)
+		}
+		ls, err := sto.List(t.Context(), dir+"/", recursive)
+		switch {
+		case ts.RejectTrailingSlash && err == nil:
+			t.Fatalf("List(%s/, %v) should fail: RejectTrailingSlash is true", dir, recursive)
+		case ts.RejectTrailingSlash:
+			continue
+		case err != nil:
+			t.Fatalf("List(%s/, %v) with trailing slash failed: %s", dir, recursive, err)
+		}
+		sort.Strings(ls)
+		sort.Strings(exp)
+		got := fmt.Sprintf("%#v", ls)
+		if exp := fmt.Sprintf("%#v", exp); got != exp {
+			t.Fatalf("List(%s/, %v) with trailing slash failed: it should return %s like List(%s, %v), not %s", dir, recursive, exp, dir, recursive, got)
+		}
+	}
+}
+
+// testListRoot checks List of the empty prefix, like a scan of the whole
+// Storage, returns the stored keys among the keys of other tests
+func (ts *Suite) testListRoot(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	keys := []string{dir + "/a", dir + "/b/c"}
+	for _, k := range keys {
+		if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+			t.Fatalf("Store(%s) failed: %s", k, err)
+		}
+	}
+
+	for _, recursive := range []bool{false, true} {
+		ls, err := sto.List(t.Context(), "", recursive)
+		switch {
+		case ts.RejectEmptyPrefix && err == nil:
+			t.Fatalf("List(\"\", %v) should fail: RejectEmptyPrefix is true", recursive)
+		case ts.RejectEmptyPrefix:
+			continue
+		case err != nil:
+			t.Fatalf("List(\"\", %v) failed: %s", recursive, err)
+		}
+		ts.checkListPrefix(t, ls, "", recursive)
+		ts.checkListSorted(t, ls, "", recursive)
+		exp := []string{dir}
+		if recursive {
+			exp = append(exp, dir+"/a", dir+"/b", dir+"/b/c")
+		}
+		for _, k := range exp {
+			if !slices.Contains(ls, k) {
+				t.Fatalf("List(\"\", %v) failed: key %s is not listed", recursive, k)
+			}
+		}
+		if !recursive && slices.Contains(ls, keys[0]) {
+			t.Fatalf("List(\"\", false) failed: key %s under %s is listed", keys[0], dir)
+		}
+	}
+}
+
+// streamingLister returns s as a StreamingLister, if it is one.
+// The wrappers Run adds for latency, profiling, context values or consistency
+// are StreamingListers if the Storage they wrap is one.
+func streamingLister(s certmagic.Storage) (StreamingLister, bool) {
+	var inner certmagic.Storage
+	switch w := s.(type) {
+	case *latencyStorage:
+		inner = w.Storage
+	case *profiledStorage:
+		inner = w.Storage
+	case *contextStorage:
+		inner = w.Storage
+	case *consistentStorage:
+		inner = w.Storage
+	default:
+		sl, ok := s.(StreamingLister)
+		return sl, ok
+	}
+	if _, ok := streamingLister(inner); !ok {
+		return nil, false
+	}
+	return s.(StreamingLister), true
+}
+
+// testListStreamDeletes checks that keys deleted while a StreamingLister
+// streams them are neither returned twice nor corrupt the result,
+// and that the keys that are not deleted are all returned
+func (ts *Suite) testListStreamDeletes(t *testing.T) {
+	sl, ok := streamingLister(ts.S)
+	if !ok {
+		return
+	}
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+
+	keys := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		k := fmt.Sprintf("%s/k%02d", dir, i)
+		keys[k] = true
+		if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+			t.Fatalf("Store(%s) failed: %s", k, err)
+		}
+	}
+
+	// after the n-th key is returned, victims[n] is deleted; it may be
+	// returned earlier, and is then already deleted, or not at all
+	victims := map[int]string{
+		1:  dir + "/k19",
+		5:  dir + "/k10",
+		10: dir + "/k05",
+		15: dir + "/k00",
+	}
+	var ls []string
+	listed := map[string]bool{}
+	deleted := map[string]bool{}
+	err := sl.ListStream(t.Context(), dir, false, func(key string) error {
+		ls = append(ls, key)
+		listed[key] = true
+		// each returned key is deleted, like certmagic cleaning up a directory
+		if err := sto.Delete(t.Context(), key); err != nil {
+			return fmt.Errorf("Delete(%s) failed: %w", key, err)
+		}
+		if v, ok := victims[len(ls)]; ok && !listed[v] {
+			if err := sto.Delete(t.Context(), v); err != nil {
+				return fmt.Errorf("Delete(%s) failed: %w", v, err)
+			}
+			deleted[v] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ListStream(%s, false) with Deletes during iteration failed: %s", dir, err)
+	}
+	ts.checkListSubset(t, ls, dir, false, keys)
+	for k := range keys {
+		if !listed[k] && !deleted[k] {
+			t.Fatalf("ListStream(%s, false) with Deletes during iteration failed: key %s wasn't deleted, but isn't returned", dir, k)
+		}
+	}
+}
+
+func (ts *Suite) testListStat(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	leaves := map[string]bool{
+		dir + "/a":     true,
+		dir + "/b/c":   true,
+		dir + "/b/d/e": true,
+	}
+	for k := range leaves {
+		if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+			t.Fatalf("Store(%s) failed: %s", k, err)
+		}
+	}
+
+	for _, recursive := range []bool{false, true} {
+		ls, err := sto.List(t.Context(), dir, recursive)
+		if err != nil {
+			t.Fatalf("List(%s, %v) failed: %s", dir, recursive, err)
+		}
+		for _, k := range ls {
+			switch inf, err := sto.Stat(t.Context(), k); {
+			case err != nil:
+				t.Fatalf("Stat(%s) of key listed by List(%s, %v) failed: %s", k, dir, recursive, err)
+			case inf.Key != k:
+				t.Fatalf("Stat(%s) of key listed by List(%s, %v) failed: Key is set to %#v", k, dir, recursive, inf.Key)
+			case leaves[k] && !inf.IsTerminal:
+				t.Fatalf("Stat(%s) of key listed by List(%s, %v) failed: IsTerminal should be true for non-directory keys", k, dir, recursive)
+			case !leaves[k] && inf.IsTerminal:
+				t.Fatalf("Stat(%s) of key listed by List(%s, %v) failed: IsTerminal should be false for directory keys", k, dir, recursive)
+			}
+		}
+	}
+}
+
+func (ts *Suite) testStorageKeyDepth(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	n := ts.MaxKeyDepth
+	if n <= 0 {
+		n = DefaultMaxKeyDepth
+	}
+
+	// one branch per depth, so that the first failing depth is reported
+	var segments []string
+	for depth := 1; depth <= n; depth++ {
+		segments = append(segments, fmt.Sprintf("s%d", depth))
+		key := fmt.Sprintf("%s/d%d/%s", dir, depth, strings.Join(segments, "/"))
+		val := []byte(key)
+		if err := sto.Store(t.Context(), key, val); err != nil {
+			t.Fatalf("Store(%s) failed at depth %d: %s", key, depth, err)
+		}
+		switch s, err := sto.Load(t.Context(), key); {
+		case err != nil:
+			t.Fatalf("Load(%s) failed at depth %d: %s", key, depth, err)
+		case !bytes.Equal(val, s):
+			t.Fatalf("Load(%s) failed at depth %d: loaded %#v != stored %#v", key, depth, string(s), string(val))
+		}
+	}
+
+	prefix := fmt.Sprintf("%s/d%d", dir, n)
+	for i, seg := range segments {
+		// the depth of seg, like the Store and Load messages above
+		depth := i + 1
+		ls, err := sto.List(t.Context(), prefix, false)
+		if err != nil {
+			t.Fatalf("List(%s, false) failed at depth %d: %s", prefix, depth, err)
+		}
+		child := prefix + "/" + seg
+		ts.checkListPrefix(t, ls, prefix, false)
+		got := fmt.Sprintf("%#v", ls)
+		exp := fmt.Sprintf("%#v", []string{child})
+		if got != exp {
+			t.Fatalf("List(%s, false) failed at depth %d: it should return %s, not %s", prefix, depth, exp, got)
+		}
+		prefix = child
+	}
+}
+
+func (ts *Suite) testStorageDirExists(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	sub := dir + "/p"
+	child := sub + "/child"
+
+	if sto.Exists(t.Context(), sub) {
+		t.Fatalf("Un-stored directory %s exists", sub)
+	}
+	if err := sto.Store(t.Context(), child, []byte(child)); err != nil {
+		t.Fatalf("Store(%s) failed: %s", child, err)
+	}
+	for _, k := range []string{dir, sub} {
+		if !sto.Exists(t.Context(), k) {
+			t.Fatalf("Directory %s of stored key %s doesn't exist", k, child)
+		}
+	}
+	if sto.Exists(t.Context(), dir+"/q") {
+		t.Fatalf("Un-stored directory %s exists", dir+"/q")
+	}
+
+	if err := sto.Delete(t.Context(), child); err != nil {
+		t.Fatalf("Delete(%s) failed: %s", child, err)
+	}
+	if !ts.KeepsEmptyDirs && sto.Exists(t.Context(), sub) {
+		t.Fatalf("Directory %s still exists after Delete(%s) of its last key", sub, child)
+	}
+}
+
+func (ts *Suite) testListEmptyDir(t *testing.T) {
+	if !ts.KeepsEmptyDirs {
+		return
+	}
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	child := dir + "/child"
+
+	if err := sto.Store(t.Context(), child, []byte(child)); err != nil {
+		t.Fatalf("Store(%s) failed: %s", child, err)
+	}
+	if err := sto.Delete(t.Context(), child); err != nil {
+		t.Fatalf("Delete(%s) failed: %s", child, err)
+	}
+
+	for _, recursive := range []bool{false, true} {
+		switch ls, err := sto.List(t.Context(), dir, recursive); {
+		case err != nil:
+			t.Fatalf("List(%s, %v) of empty directory failed: %s", dir, recursive, err)
+		case len(ls) != 0:
+			t.Fatalf("List(%s, %v) of empty directory failed: it returned %#v", dir, recursive, ls)
+		case ts.EmptyDirReturnsEmptySlice && ls == nil:
+			t.Fatalf("List(%s, %v) of empty directory failed: it returned nil instead of an empty slice", dir, recursive)
+		}
+	}
+}
+
+func (ts *Suite) testStorageDirChurn(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	p := dir + "/p"
+	keep := p + "/keep"
+	if err := sto.Store(t.Context(), keep, []byte(keep)); err != nil {
+		t.Fatalf("Store(%s) failed: %s", keep, err)
+	}
+
+	// creates and removes the directory markers of p/x/ and p/y/ in turn
+	for i := 0; i < 50; i++ {
+		for _, k := range []string{p + "/x/k", p + "/y/k"} {
+			if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+				t.Fatalf("Store(%s) failed after %d Store/Delete cycles: %s", k, i, err)
+			}
+			if err := sto.Delete(t.Context(), k); err != nil {
+				t.Fatalf("Delete(%s) failed after %d Store/Delete cycles: %s", k, i, err)
+			}
+		}
+	}
+
+	ls, err := sto.List(t.Context(), p, true)
+	if err != nil {
+		t.Fatalf("List(%s, true) failed after Store/Delete cycles: %s", p, err)
+	}
+	exp := map[string]bool{keep: true}
+	if ts.KeepsEmptyDirs {
+		exp[p+"/x"] = true
+		exp[p+"/y"] = true
+	}
+	ts.checkListSubset(t, ls, p, true, exp)
+	if !slices.Contains(ls, keep) {
+		t.Fatalf("List(%s, true) failed after Store/Delete cycles: key %s is not listed", p, keep)
+	}
+
+	if err := sto.Delete(t.Context(), keep); err != nil {
+		t.Fatalf("Delete(%s) failed: %s", keep, err)
+	}
+	if !ts.KeepsEmptyDirs && sto.Exists(t.Context(), p) {
+		t.Fatalf("Directory %s still exists after Store/Delete cycles and Delete(%s) of its last key", p, keep)
+	}
+}
+
+func (ts *Suite) testStorageOverwrite(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	key := dir + "/k"
+	sibling := dir + "/s"
+	val1 := []byte("v1")
+	val2 := []byte("overwritten value")
+
+	if err := sto.Store(t.Context(), sibling, val1); err != nil {
+		t.Fatalf("Store(%s) failed: %s", sibling, err)
+	}
+	if err := sto.Store(t.Context(), key, val1); err != nil {
+		t.Fatalf("Store(%s) failed: %s", key, err)
+	}
+	inf1, err := sto.Stat(t.Context(), key)
+	if err != nil {
+		t.Fatalf("Stat(%s) failed: %s", key, err)
+	}
+
+	if err := sto.Store(t.Context(), key, val2); err != nil {
+		t.Fatalf("Store(%s) overwrite failed: %s", key, err)
+	}
+
+	switch s, err := sto.Load(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Load(%s) failed after overwrite: %s", key, err)
+	case !bytes.Equal(val2, s):
+		t.Fatalf("Load(%s) failed after overwrite: loaded %#v != stored %#v", key, s, val2)
+	}
+
+	switch inf2, err := sto.Stat(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Stat(%s) failed after overwrite: %s", key, err)
+	case inf2.Key != inf1.Key:
+		t.Fatalf("Stat(%s) failed after overwrite: Key changed from %#v to %#v", key, inf1.Key, inf2.Key)
+	case !inf2.IsTerminal:
+		t.Fatalf("Stat(%s) failed after overwrite: IsTerminal should be true for non-directory keys", key)
+	case inf2.Size != 0 && inf2.Size != int64(len(val2)):
+		t.Fatalf("Stat(%s) failed after overwrite: Size is %d, but should be %d", key, inf2.Size, len(val2))
+	case inf2.Modified.Before(inf1.Modified):
+		t.Fatalf("Stat(%s) failed after overwrite: Modified went back from %s to %s", key, inf1.Modified, inf2.Modified)
+	}
+
+	for _, recursive := range []bool{false, true} {
+		ls, err := sto.List(t.Context(), dir, recursive)
+		if err != nil {
+			t.Fatalf("List(%s, %v) failed: %s", dir, recursive, err)
+		}
+		ts.checkListPrefix(t, ls, dir, recursive)
+		ts.checkListSorted(t, ls, dir, recursive)
+		sort.Strings(ls)
+		got := fmt.Sprintf("%#v", ls)
+		exp := fmt.Sprintf("%#v", []string{key, sibling})
+		if got != exp {
+			t.Fatalf("List(%s, %v) failed after overwrite: it should return %s, not %s", dir, recursive, exp, got)
+		}
+	}
+}
+
+func (ts *Suite) testStorageModifiedOnRead(t *testing.T) {
+	sto := ts.S
+	key := ts.randKey()
+	ts.addCleanupKeys(key)
+
+	if err := sto.Store(t.Context(), key, []byte(key)); err != nil {
+		t.Fatalf("Store(%s) failed: %s", key, err)
+	}
+	exp, err := sto.Stat(t.Context(), key)
+	if err != nil {
+		t.Fatalf("Stat(%s) failed: %s", key, err)
+	}
+
+	for i := 0; i < 5; i++ {
+		// give backends updating Modified on reads a chance to set a different time
+		time.Sleep(10 * time.Millisecond)
+		if _, err := sto.Load(t.Context(), key); err != nil {
+			t.Fatalf("Load(%s) failed: %s", key, err)
+		}
+		if _, err := sto.Stat(t.Context(), key); err != nil {
+			t.Fatalf("Stat(%s) failed: %s", key, err)
+		}
+	}
+
+	switch inf, err := sto.Stat(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Stat(%s) failed: %s", key, err)
+	case !inf.Modified.Equal(exp.Modified):
+		t.Fatalf("Stat(%s) failed: Modified changed from %s to %s by Load and Stat", key, exp.Modified, inf.Modified)
+	}
+}
+
+func (ts *Suite) testStorageIdenticalStores(t *testing.T) {
+	sto := ts.S
+	key := ts.randKey()
+	ts.addCleanupKeys(key)
+	val := []byte(key)
+
+	var prev certmagic.KeyInfo
+	for i := 0; i < 5; i++ {
+		if i > 0 {
+			// let the clock of backends bumping Modified move on
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err := sto.Store(t.Context(), key, val); err != nil {
+			t.Fatalf("Store(%s) failed on identical Store %d: %s", key, i, err)
+		}
+		inf, err := sto.Stat(t.Context(), key)
+		if err != nil {
+			t.Fatalf("Stat(%s) failed: %s", key, err)
+		}
+		switch {
+		case i == 0 || inf.Modified.IsZero():
+		case ts.SkipsIdenticalStores && !inf.Modified.Equal(prev.Modified):
+			t.Fatalf("Stat(%s) failed: Modified changed from %s to %s by identical Store %d", key, prev.Modified, inf.Modified, i)
+		case ts.SkipsIdenticalStores:
+		case ts.ModifiedAdvances && !inf.Modified.After(prev.Modified):
+			t.Fatalf("Stat(%s) failed: Modified didn't advance from %s by identical Store %d", key, prev.Modified, i)
+		case inf.Modified.Before(prev.Modified):
+			t.Fatalf("Stat(%s) failed: Modified went back from %s to %s by identical Store %d", key, prev.Modified, inf.Modified, i)
+		}
+		prev = inf
+	}
+
+	switch s, err := sto.Load(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Load(%s) failed: %s", key, err)
+	case !bytes.Equal(val, s):
+		t.Fatalf("Load(%s) failed: loaded %#v != stored %#v", key, string(s), string(val))
+	}
+}
+
+func (ts *Suite) testStorageReadAfterWrite(t *testing.T) {
+	sto := ts.S
+	key := ts.randKey()
+	ts.addCleanupKeys(key)
+
+	for i := 0; i < 200; i++ {
+		val := []byte(fmt.Sprintf("%s=%d", key, i))
+		if err := sto.Store(t.Context(), key, val); err != nil {
+			t.Fatalf("Store(%s) #%d failed: %s", key, i, err)
+		}
+		var s []byte
+		var err error
+		ts.eventually(false, func() bool {
+			s, err = sto.Load(t.Context(), key)
+			return err == nil && bytes.Equal(val, s)
+		})
+		switch {
+		case err != nil:
+			t.Fatalf("Load(%s) after Store #%d failed: %s", key, i, err)
+		case !bytes.Equal(val, s):
+			t.Fatalf("Load(%s) after Store #%d failed: loaded %#v != stored %#v", key, i, string(s), string(val))
+		}
+	}
+}
+
+// testStorageConsistency checks that Load reflects Store and Delete right away
+// unless AsyncWrites is set, and Exists and List too unless they're eventually consistent
+func (ts *Suite) testStorageConsistency(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	key := dir + "/k"
+	val := []byte(key)
+
+	if err := sto.Store(t.Context(), key, val); err != nil {
+		t.Fatalf("Store(%s) failed: %s", key, err)
+	}
+	var s []byte
+	var err error
+	ts.eventually(false, func() bool {
+		s, err = sto.Load(t.Context(), key)
+		return err == nil && bytes.Equal(val, s)
+	})
+	switch {
+	case err != nil:
+		t.Fatalf("Load(%s) right after Store failed: %s", key, err)
+	case !bytes.Equal(val, s):
+		t.Fatalf("Load(%s) right after Store failed: loaded %#v != stored %#v", key, string(s), string(val))
+	}
+	if !ts.eventually(ts.ExistsEventuallyConsistent, func() bool { return sto.Exists(t.Context(), key) }) {
+		t.Fatalf("Stored key %s doesn't exists", key)
+	}
+	listed := ts.eventually(ts.ListEventuallyConsistent, func() bool {
+		ls, err := sto.List(t.Context(), dir, false)
+		return err == nil && slices.Equal(ls, []string{key})
+	})
+	if !listed {
+		t.Fatalf("List(%s, false) failed: stored key %s is not the only listed key", dir, key)
+	}
+
+	if err := sto.Delete(t.Context(), key); err != nil {
+		t.Fatalf("Delete(%s) failed: %s", key, err)
+	}
+	deleted := ts.eventually(false, func() bool {
+		_, err := sto.Load(t.Context(), key)
+		return err != nil
+	})
+	if !deleted {
+		t.Fatalf("Load(%s) right after Delete should fail", key)
+	}
+	if !ts.eventually(ts.ExistsEventuallyConsistent, func() bool { return !sto.Exists(t.Context(), key) }) {
+		t.Fatalf("Deleted key still %s exists", key)
+	}
+	unlisted := ts.eventually(ts.ListEventuallyConsistent, func() bool {
+		ls, _ := sto.List(t.Context(), dir, false)
+		return !slices.Contains(ls, key)
+	})
+	if !unlisted {
+		t.Fatalf("List(%s, false) failed: deleted key %s is still listed", dir, key)
+	}
+}
+
+func (ts *Suite) testStorageBatchExists(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%s/k%d", dir, i)
+		if err := sto.Store(t.Context(), keys[i], []byte(keys[i])); err != nil {
+			t.Fatalf("Store(%s) failed: %s", keys[i], err)
+		}
+	}
+	for _, k := range keys {
+		if !ts.eventually(ts.ExistsEventuallyConsistent, func() bool { return sto.Exists(t.Context(), k) }) {
+			t.Fatalf("Key %s stored by a batch of %d Stores doesn't exist", k, len(keys))
+		}
+	}
+}
+
+func (ts *Suite) testStorageShrinkSize(t *testing.T) {
+	sto := ts.S
+	key := ts.randKey()
+	ts.addCleanupKeys(key)
+	large := patternValue(10 << 10)
+	small := large[:10]
+
+	if err := sto.Store(t.Context(), key, large); err != nil {
+		t.Fatalf("Store(%s) failed: %s", key, err)
+	}
+	switch inf, err := sto.Stat(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Stat(%s) failed: %s", key, err)
+	case inf.Size == 0:
+		// Size is optional
+		return
+	case inf.Size != int64(len(large)):
+		t.Fatalf("Stat(%s) failed: Size is %d, but should be %d", key, inf.Size, len(large))
+	}
+
+	if err := sto.Store(t.Context(), key, small); err != nil {
+		t.Fatalf("Store(%s) overwrite failed: %s", key, err)
+	}
+	switch inf, err := sto.Stat(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Stat(%s) failed after overwrite: %s", key, err)
+	case inf.Size != int64(len(small)):
+		t.Fatalf("Stat(%s) failed after overwrite with a smaller value: Size is %d, but should be %d", key, inf.Size, len(small))
+	}
+}
+
+func (ts *Suite) testStorageBinaryValues(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	vals := map[string][]byte{
+		"utf8":  []byte("h\u00e9llo, \u4e16\u754c \U0001f512"),
+		"cont":  {0x80, 0xbf, 0x80, 0xbf},
+		"trunc": {'a', 0xe4, 0xb8},
+		"ff":    {0xff, 0xfe, 0x00, 0xc0, 0xaf},
+		"bytes": all,
+	}
+
+	for name, val := range vals {
+		key := dir + "/" + name
+		if err := sto.Store(t.Context(), key, val); err != nil {
+			t.Fatalf("Store(%s) failed: %s", key, err)
+		}
+		switch s, err := sto.Load(t.Context(), key); {
+		case err != nil:
+			t.Fatalf("Load(%s) failed: %s", key, err)
+		case !bytes.Equal(val, s):
+			t.Fatalf("Load(%s) failed: loaded %#v != stored %#v", key, s, val)
+		}
+	}
+}
+
+func (ts *Suite) testStorageEmptyValue(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	key := dir + "/empty"
+	sub := dir + "/sub"
+
+	if err := sto.Store(t.Context(), key, []byte{}); err != nil {
+		t.Fatalf("Store(%s) with empty value failed: %s", key, err)
+	}
+	if err := sto.Store(t.Context(), sub+"/k", []byte(key)); err != nil {
+		t.Fatalf("Store(%s) failed: %s", sub+"/k", err)
+	}
+
+	ls, err := sto.List(t.Context(), dir, true)
+	if err != nil {
+		t.Fatalf("List(%s, true) failed: %s", dir, err)
+	}
+	if !slices.Contains(ls, key) {
+		t.Fatalf("List(%s, true) failed: key %s with empty value is not listed", dir, key)
+	}
+	ts.checkListSubset(t, ls, dir, true, map[string]bool{key: true, sub: true, sub + "/k": true})
+
+	switch inf, err := sto.Stat(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Stat(%s) failed: %s", key, err)
+	case inf.Key != key:
+		t.Fatalf("Stat(%s) failed: Key is set to %#v, but should be %#v", key, inf.Key, key)
+	case !inf.IsTerminal:
+		t.Fatalf("Stat(%s) failed: IsTerminal should be true for keys with an empty value", key)
+	case inf.Size != 0:
+		t.Fatalf("Stat(%s) failed: Size is %d, but should be 0", key, inf.Size)
+	}
+
+	switch s, err := sto.Load(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Load(%s) with empty value failed: %s", key, err)
+	case len(s) != 0:
+		t.Fatalf("Load(%s) with empty value failed: loaded %#v", key, s)
+	}
+}
+
+func (ts *Suite) testStorageSingleByte(t *testing.T) {
+	sto := ts.S
+	key := ts.randKey()
+	ts.addCleanupKeys(key)
+	val := []byte{0x42}
+
+	if err := sto.Store(t.Context(), key, val); err != nil {
+		t.Fatalf("Store(%s) of a single byte failed: %s", key, err)
+	}
+	switch s, err := sto.Load(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Load(%s) of a single byte failed: %s", key, err)
+	case !bytes.Equal(val, s):
+		t.Fatalf("Load(%s) of a single byte failed: loaded %#v != stored %#v", key, s, val)
+	}
+	switch inf, err := sto.Stat(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Stat(%s) of a single byte failed: %s", key, err)
+	case inf.Size != 0 && inf.Size != 1:
+		t.Fatalf("Stat(%s) of a single byte failed: Size is %d, but should be 1", key, inf.Size)
+	}
+}
+
+func (ts *Suite) testStorageTrailingNuls(t *testing.T) {
+	sto := ts.S
+	key := ts.randKey()
+	ts.addCleanupKeys(key)
+	// C strings and fixed-width columns would drop the NULs
+	val := []byte{1, 2, 3, 0, 0, 0}
+
+	if err := sto.Store(t.Context(), key, val); err != nil {
+		t.Fatalf("Store(%s) failed: %s", key, err)
+	}
+	switch s, err := sto.Load(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Load(%s) failed: %s", key, err)
+	case !bytes.Equal(val, s):
+		t.Fatalf("Load(%s) failed: loaded %#v != stored %#v with trailing NULs", key, s, val)
+	}
+	switch inf, err := sto.Stat(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Stat(%s) failed: %s", key, err)
+	case inf.Size != 0 && inf.Size != int64(len(val)):
+		t.Fatalf("Stat(%s) failed: Size is %d, but should be %d including trailing NULs", key, inf.Size, len(val))
+	}
+}
+
+func (ts *Suite) testStorageKeyInValue(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	key := dir + "/k1"
+	// the value looks like keys under key and its directory
+	val := []byte(key + "/" + key + "\n" + dir + "/k2/k3")
+
+	if err := sto.Store(t.Context(), key, val); err != nil {
+		t.Fatalf("Store(%s) failed: %s", key, err)
+	}
+	switch s, err := sto.Load(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Load(%s) failed: %s", key, err)
+	case !bytes.Equal(val, s):
+		t.Fatalf("Load(%s) failed: loaded %#v != stored %#v", key, string(s), string(val))
+	}
+
+	for _, recursive := range []bool{false, true} {
+		ls, err := sto.List(t.Context(), dir, recursive)
+		if err != nil {
+			t.Fatalf("List(%s, %v) failed: %s", dir, recursive, err)
+		}
+		ts.checkListPrefix(t, ls, dir, recursive)
+		got := fmt.Sprintf("%#v", ls)
+		exp := fmt.Sprintf("%#v", []string{key})
+		if got != exp {
+			t.Fatalf("List(%s, %v) failed: it should return %s, not %s", dir, recursive, exp, got)
+		}
+	}
+	if sto.Exists(t.Context(), dir+"/k2") {
+		t.Fatalf("Key %s named in the value of %s exists", dir+"/k2", key)
+	}
+
+	// separators a backend framing values with them could strip or collapse
+	for _, v := range []string{"a/b/c/d/e", "/", "//", "/a//b/"} {
+		val := []byte(v)
+		if err := sto.Store(t.Context(), key, val); err != nil {
+			t.Fatalf("Store(%s) failed: %s", key, err)
+		}
+		switch s, err := sto.Load(t.Context(), key); {
+		case err != nil:
+			t.Fatalf("Load(%s) failed: %s", key, err)
+		case !bytes.Equal(val, s):
+			t.Fatalf("Load(%s) failed: loaded %#v != stored %#v", key, string(s), v)
+		}
+	}
+}
+
+func (ts *Suite) testStorageMutatedValue(t *testing.T) {
+	sto := ts.S
+	key := ts.randKey()
+	ts.addCleanupKeys(key)
+	exp := patternValue(64 << 10)
+	val := bytes.Clone(exp)
+
+	if err := sto.Store(t.Context(), key, val); err != nil {
+		t.Fatalf("Store(%s) failed: %s", key, err)
+	}
+	// certmagic may reuse its buffer once Store returns
+	for i := range val {
+		val[i] = ^val[i]
+	}
+	switch s, err := sto.Load(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Load(%s) failed: %s", key, err)
+	case !bytes.Equal(exp, s):
+		t.Fatalf("Load(%s) failed: the value changed when the slice passed to Store was modified after Store returned", key)
+	}
+}
+
+func (ts *Suite) testStoragePrintableKeys(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+
+	var segs []string
+	for c := byte(0x20); c <= 0x7e; c++ {
+		if c != '/' {
+			segs = append(segs, "a"+string(c)+"z")
+		}
+	}
+	var keys []string
+	for _, seg := range ts.supportedSegments(segs) {
+		c := seg[1]
+		key := dir + "/" + seg
+		keys = append(keys, key)
+		val := []byte(key)
+		if err := sto.Store(t.Context(), key, val); err != nil {
+			t.Fatalf("Store(%s) with character %q in key failed: %s", key, c, err)
+		}
+		switch s, err := sto.Load(t.Context(), key); {
+		case err != nil:
+			t.Fatalf("Load(%s) with character %q in key failed: %s", key, c, err)
+		case !bytes.Equal(val, s):
+			t.Fatalf("Load(%s) with character %q in key failed: loaded %#v != stored %#v", key, c, s, val)
+		}
+	}
+
+	ls, err := sto.List(t.Context(), dir, false)
+	if err != nil {
+		t.Fatalf("List(%s, false) failed: %s", dir, err)
+	}
+	stored := map[string]bool{}
+	for _, key := range keys {
+		if !slices.Contains(ls, key) {
+			t.Fatalf("List(%s, false) failed: key %#v is not listed", dir, key)
+		}
+		stored[key] = true
+	}
+	ts.checkListSubset(t, ls, dir, false, stored)
+}
+
+func (ts *Suite) testStorageDeleteDir(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	keys := []string{dir + "/k1", dir + "/k/a/b", dir + "/k/c"}
+
+	for _, k := range keys {
+		if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+			t.Fatalf("Store(%s) failed: %s", k, err)
+		}
+	}
+
+	if ts.RejectDirDelete {
+		if err := sto.Delete(t.Context(), dir); err == nil {
+			t.Fatalf("Delete(%s) should fail: the key is a directory", dir)
+		}
+		for _, k := range keys {
+			switch s, err := sto.Load(t.Context(), k); {
+			case err != nil:
+				t.Fatalf("Load(%s) failed after rejected Delete(%s): %s", k, dir, err)
+			case !bytes.Equal([]byte(k), s):
+				t.Fatalf("Load(%s) failed after rejected Delete(%s): loaded %#v != stored %#v", k, dir, s, []byte(k))
+			}
+		}
+		return
+	}
+
+	if err := sto.Delete(t.Context(), dir); err != nil {
+		t.Fatalf("Delete(%s) of directory failed: %s", dir, err)
+	}
+	if sto.Exists(t.Context(), dir) {
+		t.Fatalf("Deleted directory %s still exists", dir)
+	}
+	for _, k := range keys {
+		if sto.Exists(t.Context(), k) {
+			t.Fatalf("Key %s still exists after Delete(%s) of its directory", k, dir)
+		}
+		if _, err := sto.Load(t.Context(), k); err == nil {
+			t.Fatalf("Load(%s) should fail: its directory %s was deleted", k, dir)
+		}
+	}
+}
+
+func (ts *Suite) testStorageKeyCollisions(t *testing.T) {
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+
+	// each group of keys would collide under a common lossy key encoding
+	groups := [][]string{
+		{"Key", "key", "KEY"},
+		{"a b", "a_b", "a-b", "a:b"},
+		{"a+b", "a_plus_b"},
+		{"a..b", "ab", "a.b"},
+		{"*.example.com", "wildcard_.example.com"},
+		{"a%2Fb", "a%252Fb"},
+	}
+	var segs []string
+	for _, g := range groups {
+		segs = append(segs, g...)
+	}
+	ts.checkDistinctKeys(t, dir, segs)
+}
+
+// supportedSegments returns the segments of segs that are valid
+// and distinct from the previous ones under the key limitations
+// set by CaseInsensitiveKeys and WindowsFileNames
+func (ts *Suite) supportedSegments(segs []string) []string {
+	var supported []string
+	for _, seg := range segs {
+		switch {
+		case ts.WindowsFileNames && !windowsFileName(seg):
+		case ts.CaseInsensitiveKeys && slices.ContainsFunc(supported, func(s string) bool { return strings.EqualFold(s, seg) }):
+		default:
+			supported = append(supported, seg)
+		}
+	}
+	return supported
+}
+
+// windowsFileName reports whether seg is a valid Windows file name
+func windowsFileName(seg string) bool {
+	if strings.HasSuffix(seg, " ") || strings.HasSuffix(seg, ".") {
+		return false
+	}
+	return !strings.ContainsFunc(seg, func(r rune) bool {
+		return r < 0x20 || strings.ContainsRune(`\:*?"<>|`, r)
+	})
+}
+
+// checkDistinctKeys stores a key under parent for each segment of segs,
+// and fails the test if any two of them are not distinct keys that Load,
+// Stat and List return as stored
+func (ts *Suite) checkDistinctKeys(t *testing.T, parent string, segs []string) {
+	sto := ts.S
+	var keys []string
+	for _, seg := range ts.supportedSegments(segs) {
+		keys = append(keys, parent+"/"+seg)
+	}
+
+	for _, k := range keys {
+		if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+			t.Fatalf("Store(%#v) failed: %s", k, err)
+		}
+	}
+	for _, k := range keys {
+		switch s, err := sto.Load(t.Context(), k); {
+		case err != nil:
+			t.Fatalf("Load(%#v) failed: %s", k, err)
+		case !bytes.Equal([]byte(k), s):
+			t.Fatalf("Load(%#v) failed: loaded %#v, the value of a different key: the keys collide", k, string(s))
+		}
+		switch inf, err := sto.Stat(t.Context(), k); {
+		case err != nil:
+			t.Fatalf("Stat(%#v) failed: %s", k, err)
+		case inf.Key != k:
+			t.Fatalf("Stat(%#v) failed: Key is set to %#v", k, inf.Key)
+		}
+	}
+
+	ls, err := sto.List(t.Context(), parent, false)
+	if err != nil {
+		t.Fatalf("List(%s, false) failed: %s", parent, err)
+	}
+	ts.checkListPrefix(t, ls, parent, false)
+	ts.checkListSorted(t, ls, parent, false)
+	sort.Strings(ls)
+	sort.Strings(keys)
+	got := fmt.Sprintf("%#v", ls)
+	exp := fmt.Sprintf("%#v", keys)
+	if got != exp {
+		t.Fatalf("List(%s, false) failed: it should return %s, not %s", parent, exp, got)
+	}
+}
+
+func (ts *Suite) testStorageWhitespaceKeys(t *testing.T) {
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	// keys differing only in leading or trailing whitespace, which collide
+	// under a backend trimming keys
+	ts.checkDistinctKeys(t, dir, []string{"k1", "k1 ", "k1  ", "k1\t", " k1"})
+}
+
+func (ts *Suite) testStorageURLKeys(t *testing.T) {
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	// backends building URLs from keys must not parse these as a query, fragment or escape
+	ts.checkDistinctKeys(t, dir+"/acme", []string{
+		"example.com",
+		"example.com?foo=bar",
+		"example.com?foo=bar&baz=qux",
+		"example.com#foo",
+		"example.com%3Ffoo=bar",
+	})
+}
+
+func (ts *Suite) testStorageKeyPrefixInKeys(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	// a key at the root that starts with dir, like the keys of another run would
+	sibling := dir + KeyPrefix + "nested"
+	ts.addCleanupKeys(dir, sibling)
+	keys := []string{
+		dir + "/" + KeyPrefix,
+		dir + "/" + KeyPrefix + "nested",
+		dir + "/" + KeyPrefix + "sub/" + KeyPrefix,
+	}
+
+	for _, k := range append(keys, sibling) {
+		if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+			t.Fatalf("Store(%s) failed: %s", k, err)
+		}
+	}
+
+	ls, err := sto.List(t.Context(), dir, false)
+	if err != nil {
+		t.Fatalf("List(%s, false) failed: %s", dir, err)
+	}
+	ts.checkListPrefix(t, ls, dir, false)
+	ts.checkListSorted(t, ls, dir, false)
+	sort.Strings(ls)
+	got := fmt.Sprintf("%#v", ls)
+	exp := fmt.Sprintf("%#v", []string{keys[0], keys[1], dir + "/" + KeyPrefix + "sub"})
+	if got != exp {
+		t.Fatalf("List(%s, false) failed: it should return %s, not %s", dir, exp, got)
+	}
+
+	// like cleanup, which must not delete keys only sharing a string prefix
+	if err := ts.deleteKey(t.Context(), sto, dir); err != nil {
+		t.Fatalf("Delete(%s) failed: %s", dir, err)
+	}
+	for _, k := range keys {
+		if sto.Exists(t.Context(), k) {
+			t.Fatalf("Key %s still exists after Delete(%s)", k, dir)
+		}
+	}
+	switch s, err := sto.Load(t.Context(), sibling); {
+	case err != nil:
+		t.Fatalf("Load(%s) failed after Delete(%s): %s", sibling, dir, err)
+	case !bytes.Equal([]byte(sibling), s):
+		t.Fatalf("Load(%s) failed after Delete(%s): loaded %#v != stored %#v", sibling, dir, string(s), sibling)
+	}
+}
+
+func (ts *Suite) testStorageKeyPrefixDir(t *testing.T) {
+	sto := ts.S
+	// the same name, as a single segment and as a child of KeyPrefix
+	bare := ts.randKey()
+	child := KeyPrefix + "/" + strings.TrimPrefix(bare, KeyPrefix)
+	sto.Delete(t.Context(), child)
+	// KeyPrefix itself becomes a directory, kept by KeepsEmptyDirs Storages
+	ts.addCleanupKeys(bare, child, KeyPrefix)
+
+	for _, k := range []string{bare, child} {
+		if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+			t.Fatalf("Store(%s) failed: %s", k, err)
+		}
+	}
+	for _, k := range []string{bare, child} {
+		switch s, err := sto.Load(t.Context(), k); {
+		case err != nil:
+			t.Fatalf("Load(%s) failed: %s", k, err)
+		case !bytes.Equal([]byte(k), s):
+			t.Fatalf("Load(%s) failed: loaded %#v, the value of another key", k, string(s))
+		}
+	}
+
+	switch ls, err := sto.List(t.Context(), KeyPrefix, false); {
+	case err != nil:
+		t.Fatalf("List(%s, false) failed: %s", KeyPrefix, err)
+	case !slices.Contains(ls, child):
+		t.Fatalf("List(%s, false) failed: key %s is not listed", KeyPrefix, child)
+	case slices.Contains(ls, bare):
+		t.Fatalf("List(%s, false) failed: key %s at the root is listed", KeyPrefix, bare)
+	}
+	switch ls, err := sto.List(t.Context(), "", false); {
+	case ts.RejectEmptyPrefix:
+	case err != nil:
+		t.Fatalf("List(\"\", false) failed: %s", err)
+	case !slices.Contains(ls, bare) || !slices.Contains(ls, KeyPrefix):
+		t.Fatalf("List(\"\", false) failed: it should return both %s and %s", bare, KeyPrefix)
+	case slices.Contains(ls, child):
+		t.Fatalf("List(\"\", false) failed: key %s under %s is listed", child, KeyPrefix)
+	}
+
+	if err := sto.Delete(t.Context(), child); err != nil {
+		t.Fatalf("Delete(%s) failed: %s", child, err)
+	}
+	if !sto.Exists(t.Context(), bare) {
+		t.Fatalf("Key %s doesn't exist after Delete(%s)", bare, child)
+	}
+}
+
+func (ts *Suite) testStorageNulKey(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	short := dir + "/a"
+	key := short + "\x00b"
+
+	if err := sto.Store(t.Context(), short, []byte(short)); err != nil {
+		t.Fatalf("Store(%#v) failed: %s", short, err)
+	}
+	// the key may be rejected, but must not be truncated at the NUL
+	if err := sto.Store(t.Context(), key, []byte(key)); err == nil {
+		switch s, err := sto.Load(t.Context(), key); {
+		case err != nil:
+			t.Fatalf("Load(%#v) failed: %s", key, err)
+		case !bytes.Equal([]byte(key), s):
+			t.Fatalf("Load(%#v) failed: loaded %#v, the value of another key", key, string(s))
+		}
+	}
+	switch s, err := sto.Load(t.Context(), short); {
+	case err != nil:
+		t.Fatalf("Load(%#v) failed after Store(%#v): %s", short, key, err)
+	case !bytes.Equal([]byte(short), s):
+		t.Fatalf("Load(%#v) failed: loaded %#v stored at %#v", short, string(s), key)
+	}
+}
+
+func (ts *Suite) testStorageAstralKeys(t *testing.T) {
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	// keys differing only in a codepoint outside the BMP, which collide
+	// under an encoding replacing them with U+FFFD or keeping one UTF-16
+	// surrogate: U+1F512 and U+1F513 share their high surrogate
+	var segs []string
+	for _, c := range []string{"\U0001f512", "\U0001f513", "\U0001f600", "\U00020000", "\U00020001", "\ufffd"} {
+		segs = append(segs, "k"+c+".example")
+	}
+	ts.checkDistinctKeys(t, dir, segs)
+}
+
+func (ts *Suite) testListUnicodeNormalization(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	// the same IDN label in Unicode normalization forms NFC and NFD
+	forms := map[string]string{
+		"NFC": "b\u00fccher.example",
+		"NFD": "bu\u0308cher.example",
+	}
+
+	// keys are compared byte by byte, so a prefix in one form
+	// must not match keys stored in the other
+	for stored, other := range map[string]string{"NFC": "NFD", "NFD": "NFC"} {
+		sub := dir + "/" + stored
+		prefix := sub + "/" + forms[stored]
+		key := prefix + "/k"
+		if err := sto.Store(t.Context(), key, []byte(key)); err != nil {
+			t.Fatalf("Store(%#v) failed: %s", key, err)
+		}
+
+		ls, err := sto.List(t.Context(), prefix, false)
+		if err != nil {
+			t.Fatalf("List(%#v, false) with %s prefix failed: %s", prefix, stored, err)
+		}
+		ts.checkListPrefix(t, ls, prefix, false)
+		got := fmt.Sprintf("%#v", ls)
+		exp := fmt.Sprintf("%#v", []string{key})
+		if got != exp {
+			t.Fatalf("List(%#v, false) with %s prefix failed: it should return %s, not %s", prefix, stored, exp, got)
+		}
+
+		if ts.NormalizesKeys {
+			continue
+		}
+		otherPrefix := sub + "/" + forms[other]
+		if ls, err := sto.List(t.Context(), otherPrefix, false); err == nil && len(ls) != 0 {
+			t.Fatalf("List(%#v, false) with %s prefix failed: it should not return keys stored with %s prefix, but returned %#v", otherPrefix, other, stored, ls)
+		}
+	}
+}
+
+func (ts *Suite) testListLarge(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	n := ts.LargeListSize
+	if n <= 0 {
+		n = DefaultLargeListSize
+	}
+
+	keys := map[string]bool{}
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf("%s/k%d", dir, i)
+		keys[k] = true
+		if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+			t.Fatalf("Store(%s) failed: %s", k, err)
+		}
+	}
+
+	for _, recursive := range []bool{false, true} {
+		ls, err := sto.List(t.Context(), dir, recursive)
+		if err != nil {
+			t.Fatalf("List(%s, %v) failed: %s", dir, recursive, err)
+		}
+		if len(ls) < n {
+			t.Fatalf("List(%s, %v) failed: it returned %d keys, %d short of the %d stored", dir, recursive, len(ls), n-len(ls), n)
+		}
+		ts.checkListSubset(t, ls, dir, recursive, keys)
+	}
+}
+
+func (ts *Suite) testDeleteLarge(t *testing.T) {
+	if ts.MaxDeleteDuration <= 0 {
+		return
+	}
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	n := ts.LargeListSize
+	if n <= 0 {
+		n = DefaultLargeListSize
+	}
+
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf("%s/k%d", dir, i)
+		if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+			t.Fatalf("Store(%s) failed: %s", k, err)
+		}
+	}
+
+	key := fmt.Sprintf("%s/k%d", dir, n/2)
+	start := time.Now()
+	if err := sto.Delete(t.Context(), key); err != nil {
+		t.Fatalf("Delete(%s) failed: %s", key, err)
+	}
+	if d := time.Since(start); d > ts.MaxDeleteDuration {
+		t.Fatalf("Delete(%s) of one of %d keys took %s, more than MaxDeleteDuration (%s)", key, n, d, ts.MaxDeleteDuration)
+	}
+	if sto.Exists(t.Context(), key) {
+		t.Fatalf("Deleted key still %s exists", key)
+	}
+}
+
+func (ts *Suite) testListCancelled(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+
+	var keys []string
+	for i := 0; i < 200; i++ {
+		k := fmt.Sprintf("%s/k%d", dir, i)
+		keys = append(keys, k)
+		if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+			t.Fatalf("Store(%s) failed: %s", k, err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		// the List may complete before it's cancelled, or fail
+		ctx, cancel := context.WithCancel(t.Context())
+		go func() {
+			time.Sleep(time.Duration(i) * 100 * time.Microsecond)
+			cancel()
+		}()
+		sto.List(ctx, dir, true)
+		<-ctx.Done()
+	}
+
+	k := fmt.Sprintf("%s/k%d", dir, len(keys))
+	keys = append(keys, k)
+	if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+		t.Fatalf("Store(%s) after cancelled List failed: %s", k, err)
+	}
+	if _, err := sto.Load(t.Context(), k); err != nil {
+		t.Fatalf("Load(%s) after cancelled List failed: %s", k, err)
+	}
+
+	ls, err := sto.List(t.Context(), dir, true)
+	if err != nil {
+		t.Fatalf("List(%s, true) after cancelled List failed: %s", dir, err)
+	}
+	ts.checkListPrefix(t, ls, dir, true)
+	ts.checkListSorted(t, ls, dir, true)
+	sort.Strings(ls)
+	sort.Strings(keys)
+	got := fmt.Sprintf("%#v", ls)
+	exp := fmt.Sprintf("%#v", keys)
+	if got != exp {
+		t.Fatalf("List(%s, true) after cancelled List failed: it should return %s, not %s", dir, exp, got)
+	}
+}
+
+func (ts *Suite) testStorageMaxValueSize(t *testing.T) {
+	if ts.MaxValueSize <= 0 {
+		return
+	}
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	val := patternValue(ts.MaxValueSize + 1)
+
+	key := dir + "/max"
+	if err := sto.Store(t.Context(), key, val[:ts.MaxValueSize]); err != nil {
+		t.Fatalf("Store(%s) of MaxValueSize (%d bytes) failed: %s", key, ts.MaxValueSize, err)
+	}
+	switch s, err := sto.Load(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Load(%s) of MaxValueSize (%d bytes) failed: %s", key, ts.MaxValueSize, err)
+	case !bytes.Equal(val[:ts.MaxValueSize], s):
+		t.Fatalf("Load(%s) of MaxValueSize (%d bytes) failed: loaded %d bytes differ from stored value", key, ts.MaxValueSize, len(s))
+	}
+
+	over := dir + "/over"
+	if err := sto.Store(t.Context(), over, val); err != nil {
+		if ts.RejectLargeValues && !errors.Is(err, ErrValueTooLarge) {
+			t.Logf("Store(%s) of MaxValueSize+1 (%d bytes) failed with an error not wrapping ErrValueTooLarge: %s", over, len(val), err)
+		}
+		if _, err := sto.Load(t.Context(), over); err == nil {
+			t.Fatalf("Load(%s) should fail: Store of MaxValueSize+1 (%d bytes) failed", over, len(val))
+		}
+		return
+	}
+	if ts.RejectLargeValues {
+		t.Fatalf("Store(%s) of MaxValueSize+1 (%d bytes) should fail: MaxValueSize is a hard limit", over, len(val))
+	}
+	switch s, err := sto.Load(t.Context(), over); {
+	case err != nil:
+		t.Fatalf("Load(%s) of MaxValueSize+1 (%d bytes) failed: %s", over, len(val), err)
+	case !bytes.Equal(val, s):
+		t.Fatalf("Load(%s) of MaxValueSize+1 (%d bytes) failed: loaded %d bytes differ from stored value", over, len(val), len(s))
+	}
+}
+
+func (ts *Suite) testStorageStrategyBoundary(t *testing.T) {
+	if ts.StrategyBoundary <= 0 {
+		return
+	}
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+
+	for _, n := range []int{ts.StrategyBoundary - 1, ts.StrategyBoundary, ts.StrategyBoundary + 1} {
+		key := fmt.Sprintf("%s/k%d", dir, n)
+		val := patternValue(n)
+		if err := sto.Store(t.Context(), key, val); err != nil {
+			t.Fatalf("Store(%s) of %d bytes failed: %s", key, n, err)
+		}
+		switch s, err := sto.Load(t.Context(), key); {
+		case err != nil:
+			t.Fatalf("Load(%s) of %d bytes failed: %s", key, n, err)
+		case !bytes.Equal(val, s):
+			t.Fatalf("Load(%s) of %d bytes failed: it returned %d different bytes", key, n, len(s))
+		}
+		switch inf, err := sto.Stat(t.Context(), key); {
+		case err != nil:
+			t.Fatalf("Stat(%s) of %d bytes failed: %s", key, n, err)
+		case inf.Size != 0 && inf.Size != int64(n):
+			t.Fatalf("Stat(%s) of %d bytes failed: Size is %d", key, n, inf.Size)
+		}
+	}
+}
+
+func (ts *Suite) testStorageFrameSize(t *testing.T) {
+	if ts.FrameSize <= 0 {
+		return
+	}
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+
+	for _, n := range []int{ts.FrameSize - 1, ts.FrameSize, ts.FrameSize + 1} {
+		key := fmt.Sprintf("%s/k%d", dir, n)
+		val := patternValue(n)
+		if err := sto.Store(t.Context(), key, val); err != nil {
+			if _, err := sto.Load(t.Context(), key); err == nil {
+				t.Fatalf("Load(%s) should fail: Store of %d bytes around FrameSize failed", key, n)
+			}
+			continue
+		}
+		switch s, err := sto.Load(t.Context(), key); {
+		case err != nil:
+			t.Fatalf("Load(%s) of %d bytes around FrameSize failed: %s", key, n, err)
+		case !bytes.Equal(val, s):
+			t.Fatalf("Load(%s) of %d bytes around FrameSize failed: it returned %d different bytes", key, n, len(s))
+		}
+	}
+}
+
+func (ts *Suite) testStorageLargeValue(t *testing.T) {
+	sto := ts.S
+	key := ts.randKey()
+	ts.addCleanupKeys(key)
+	n := ts.LargeValueSize
+	if n <= 0 {
+		n = DefaultLargeValueSize
+	}
+	val := patternValue(n)
+
+	if err := sto.Store(t.Context(), key, val); err != nil {
+		t.Fatalf("Store(%s) of %d bytes failed: %s", key, n, err)
+	}
+	switch s, err := sto.Load(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Load(%s) of %d bytes failed: %s", key, n, err)
+	case len(s) != n:
+		t.Fatalf("Load(%s) of %d bytes failed: it returned %d bytes", key, n, len(s))
+	case !bytes.Equal(val, s):
+		i := 0
+		for val[i] == s[i] {
+			i++
+		}
+		t.Fatalf("Load(%s) of %d bytes failed: loaded value differs from stored value at offset %d", key, n, i)
+	}
+}
+
+// checksumValueSize is the largest size of the values of testStorageChecksums
+const checksumValueSize = 1 << 20
+
+func (ts *Suite) testStorageChecksums(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	total := ts.ChecksumBytes
+	if total <= 0 {
+		total = DefaultChecksumBytes
+	}
+	size := checksumValueSize
+	if ts.MaxValueSize > 0 && ts.MaxValueSize < size {
+		size = ts.MaxValueSize
+	}
+	seed := int64(ts.Rng.Int())
+	rng := rand.New(rand.NewSource(seed))
+
+	var keys []string
+	sums := map[string][32]byte{}
+	for n := 0; n < total; {
+		key := fmt.Sprintf("%s/k%d", dir, len(keys))
+		// odd sizes, to straddle the chunk boundaries of backends
+		val := make([]byte, size/2+rng.Intn(size/2+1))
+		rng.Read(val)
+		if err := sto.Store(t.Context(), key, val); err != nil {
+			t.Fatalf("Store(%s) of %d bytes failed: %s", key, len(val), err)
+		}
+		keys = append(keys, key)
+		sums[key] = sha256.Sum256(val)
+		n += len(val)
+	}
+
+	for _, key := range keys {
+		s, err := sto.Load(t.Context(), key)
+		if err != nil {
+			t.Fatalf("Load(%s) failed: %s", key, err)
+		}
+		if sha256.Sum256(s) != sums[key] {
+			t.Fatalf("Load(%s) failed: the checksum of the loaded value doesn't match the stored value (seed %d)", key, seed)
+		}
+	}
+}
+
+func (ts *Suite) testStorageBufferSizes(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+
+	for _, size := range []int{512, 1024, 4096, 8192, 16384, 32768, 65536, 131072} {
+		for _, n := range []int{size - 1, size, size + 1} {
+			key := fmt.Sprintf("%s/%d", dir, n)
+			val := patternValue(n)
+			if err := sto.Store(t.Context(), key, val); err != nil {
+				t.Fatalf("Store(%s) of %d bytes failed: %s", key, n, err)
+			}
+			switch s, err := sto.Load(t.Context(), key); {
+			case err != nil:
+				t.Fatalf("Load(%s) of %d bytes failed: %s", key, n, err)
+			case len(s) != n:
+				t.Fatalf("Load(%s) of %d bytes failed: it returned %d bytes", key, n, len(s))
+			case !bytes.Equal(val, s):
+				t.Fatalf("Load(%s) of %d bytes failed: loaded value differs from stored value", key, n)
+			}
+		}
+	}
+}
+
+func (ts *Suite) testStorageSync(t *testing.T) {
+	if ts.Sync == nil {
+		return
+	}
+	sto := ts.S
+	key := ts.randKey()
+	ts.addCleanupKeys(key)
+	val := []byte(key)
+
+	if err := sto.Store(t.Context(), key, val); err != nil {
+		t.Fatalf("Store(%s) failed: %s", key, err)
+	}
+	if err := ts.Sync(); err != nil {
+		t.Fatalf("Sync() after Store(%s) failed: %s", key, err)
+	}
+	if ts.Reopen == nil {
+		return
+	}
+
+	switch s, err := ts.Reopen().Load(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Load(%s) of reopened storage failed after Sync(): %s", key, err)
+	case !bytes.Equal(val, s):
+		t.Fatalf("Load(%s) of reopened storage failed after Sync(): loaded %#v != stored %#v", key, s, val)
+	}
+}
+
+func (ts *Suite) testStorageRebuildIndex(t *testing.T) {
+	if ts.RebuildIndex == nil {
+		return
+	}
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	keys := []string{dir + "/k1", dir + "/k/a/b", dir + "/k/c"}
+
+	for _, k := range keys {
+		if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+			t.Fatalf("Store(%s) failed: %s", k, err)
+		}
+	}
+	if err := ts.RebuildIndex(); err != nil {
+		t.Fatalf("RebuildIndex() failed: %s", err)
+	}
+
+	for _, k := range keys {
+		switch s, err := sto.Load(t.Context(), k); {
+		case err != nil:
+			t.Fatalf("Load(%s) after RebuildIndex() failed: %s", k, err)
+		case !bytes.Equal([]byte(k), s):
+			t.Fatalf("Load(%s) after RebuildIndex() failed: loaded %#v != stored %#v", k, string(s), k)
+		}
+	}
+	ls, err := sto.List(t.Context(), dir, true)
+	if err != nil {
+		t.Fatalf("List(%s, true) after RebuildIndex() failed: %s", dir, err)
+	}
+	ts.checkListPrefix(t, ls, dir, true)
+	ts.checkListSorted(t, ls, dir, true)
+	sort.Strings(ls)
+	got := fmt.Sprintf("%#v", ls)
+	exp := fmt.Sprintf("%#v", []string{dir + "/k", dir + "/k/a", dir + "/k/a/b", dir + "/k/c", dir + "/k1"})
+	if got != exp {
+		t.Fatalf("List(%s, true) after RebuildIndex() failed: it should return %s, not %s", dir, exp, got)
+	}
+}
+
+func (ts *Suite) testStorageReopen(t *testing.T) {
+	if ts.Reopen == nil {
+		return
+	}
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	keys := []string{dir + "/k1", dir + "/k/a/b", dir + "/k/c"}
+
+	for _, k := range keys {
+		if err := ts.S.Store(t.Context(), k, []byte(k)); err != nil {
+			t.Fatalf("Store(%s) failed: %s", k, err)
+		}
+	}
+
+	sto := ts.Reopen()
+	for _, k := range keys {
+		switch s, err := sto.Load(t.Context(), k); {
+		case err != nil:
+			t.Fatalf("Load(%s) of reopened storage failed: %s", k, err)
+		case !bytes.Equal([]byte(k), s):
+			t.Fatalf("Load(%s) of reopened storage failed: loaded %#v != stored %#v", k, s, []byte(k))
+		}
+	}
+
+	ls, err := sto.List(t.Context(), dir, true)
+	if err != nil {
+		t.Fatalf("List(%s, true) of reopened storage failed: %s", dir, err)
+	}
+	sort.Strings(ls)
+	ts.checkListPrefix(t, ls, dir, true)
+	got := fmt.Sprintf("%#v", ls)
+	exp := fmt.Sprintf("%#v", []string{dir + "/k", dir + "/k/a", dir + "/k/a/b", dir + "/k/c", dir + "/k1"})
+	if got != exp {
+		t.Fatalf("List(%s, true) of reopened storage failed: it should return %s, not %s", dir, exp, got)
+	}
+}
+
+// testStorageColdLoad logs the latency of a Load of a just stored key,
+// and of the same Load by a reopened storage, whose caches are cold
+func (ts *Suite) testStorageColdLoad(t *testing.T) {
+	if ts.Reopen == nil {
+		return
+	}
+	key := ts.randKey()
+	ts.addCleanupKeys(key)
+	val := patternValue(4 << 10)
+
+	if err := ts.S.Store(t.Context(), key, val); err != nil {
+		t.Fatalf("Store(%s) failed: %s", key, err)
+	}
+	for _, c := range []struct {
+		name string
+		sto  certmagic.Storage
+	}{
+		// neither is slowed down by Latency nor profiled
+		{"warm", untimed(ts.S)},
+		{"cold", ts.Reopen()},
+	} {
+		start := time.Now()
+		s, err := c.sto.Load(t.Context(), key)
+		d := time.Since(start)
+		switch {
+		case err != nil:
+			t.Fatalf("Load(%s) %s failed: %s", key, c.name, err)
+		case !bytes.Equal(val, s):
+			t.Fatalf("Load(%s) %s failed: loaded %d bytes differ from stored value", key, c.name, len(s))
+		}
+		t.Logf("Load(%s) %s took %s", key, c.name, d)
+	}
+}
+
+func (ts *Suite) testStorageFresh(t *testing.T) {
+	if ts.Fresh == nil {
+		return
+	}
+	sto := ts.Fresh()
+	key := KeyPrefix + strconv.Itoa(ts.Rng.Int())
+	val := []byte(key)
+
+	// the first operation on the backend
+	if err := sto.Store(t.Context(), key, val); err != nil {
+		t.Fatalf("Store(%s) on a fresh storage failed: %s", key, err)
+	}
+	defer sto.Delete(context.Background(), key)
+
+	switch ls, err := sto.List(t.Context(), "", false); {
+	case ts.RejectEmptyPrefix:
+	case err != nil:
+		t.Fatalf("List(\"\", false) on a fresh storage failed: %s", err)
+	case !slices.Equal(ls, []string{key}):
+		t.Fatalf("List(\"\", false) on a fresh storage failed: it should return the only stored key %#v, not %#v", key, ls)
+	}
+	switch s, err := sto.Load(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Load(%s) on a fresh storage failed: %s", key, err)
+	case !bytes.Equal(val, s):
+		t.Fatalf("Load(%s) on a fresh storage failed: loaded %#v != stored %#v", key, string(s), string(val))
+	}
+}
+
+func (ts *Suite) testStorageUsedBytes(t *testing.T) {
+	if ts.UsedBytes == nil {
+		return
+	}
+	sto := ts.S
+	key := ts.randKey()
+	ts.addCleanupKeys(key)
+	val := patternValue(4 << 20)
+	// usage must change by at least half of the value's size,
+	// to allow for compression and accounting overhead
+	tolerance := int64(len(val) / 2)
+
+	baseline := ts.UsedBytes()
+	if err := sto.Store(t.Context(), key, val); err != nil {
+		t.Fatalf("Store(%s) failed: %s", key, err)
+	}
+	stored := ts.waitUsedBytes(func(n int64) bool { return n-baseline >= tolerance })
+	if stored-baseline < tolerance {
+		t.Fatalf("UsedBytes grew from %d to %d after Store(%s) of %d bytes", baseline, stored, key, len(val))
+	}
+
+	if err := sto.Delete(t.Context(), key); err != nil {
+		t.Fatalf("Delete(%s) failed: %s", key, err)
+	}
+	deleted := ts.waitUsedBytes(func(n int64) bool { return n-baseline < tolerance })
+	if deleted-baseline >= tolerance {
+		t.Fatalf("UsedBytes is %d after Delete(%s) of %d bytes, but was %d before Store(%s)", deleted, key, len(val), baseline, key)
+	}
+}
+
+// eventuallyConsistent reports whether the Storage may not reflect
+// a Store or Delete right away
+func (ts *Suite) eventuallyConsistent() bool {
+	return ts.AsyncWrites || ts.ListEventuallyConsistent || ts.ExistsEventuallyConsistent
+}
+
+// consistencyTimeout is how long eventually retries operations
+// of a Storage that is only eventually consistent for them
+const consistencyTimeout = 10 * time.Second
+
+// eventually calls ok until it returns true, or until consistencyTimeout
+// elapses if eventual or ts.AsyncWrites is true, and only once otherwise,
+// and returns its last result
+func (ts *Suite) eventually(eventual bool, ok func() bool) bool {
+	eventual = eventual || ts.AsyncWrites
+	deadline := time.Now().Add(consistencyTimeout)
+	for {
+		if ok() {
+			return true
+		}
+		if !eventual || time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// usedBytesTimeout is how long waitUsedBytes waits for ts.UsedBytes to settle
+const usedBytesTimeout = 10 * time.Second
+
+// waitUsedBytes polls ts.UsedBytes until ok returns true for its result,
+// or usedBytesTimeout elapses, and returns the last result
+func (ts *Suite) waitUsedBytes(ok func(int64) bool) int64 {
+	deadline := time.Now().Add(usedBytesTimeout)
+	for {
+		n := ts.UsedBytes()
+		if ok(n) || time.Now().After(deadline) {
+			return n
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (ts *Suite) testStorageDualKey(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+
+	if !ts.DualKeys {
+		key := dir + "/x"
+		child := key + "/y"
+		val := []byte(key)
+		if err := sto.Store(t.Context(), key, val); err != nil {
+			t.Fatalf("Store(%s) failed: %s", key, err)
+		}
+		if err := sto.Store(t.Context(), child, val); err == nil {
+			t.Fatalf("Store(%s) should fail: %s is a terminal key", child, key)
+		}
+		switch s, err := sto.Load(t.Context(), key); {
+		case err != nil:
+			t.Fatalf("Load(%s) failed after rejected Store(%s): %s", key, child, err)
+		case !bytes.Equal(val, s):
+			t.Fatalf("Load(%s) failed after rejected Store(%s): loaded %#v != stored %#v", key, child, s, val)
+		}
+		switch inf, err := sto.Stat(t.Context(), key); {
+		case err != nil:
+			t.Fatalf("Stat(%s) failed after rejected Store(%s): %s", key, child, err)
+		case !inf.IsTerminal:
+			t.Fatalf("Stat(%s) failed after rejected Store(%s): the key became a directory", key, child)
+		}
+		// not Exists: certmagic.FileStorage reports any error but fs.ErrNotExist as existing
+		if _, err := sto.Load(t.Context(), child); err == nil {
+			t.Fatalf("Load(%s) should fail: its Store was rejected", child)
+		}
+		switch ls, err := sto.List(t.Context(), dir, true); {
+		case err != nil:
+			t.Fatalf("List(%s, true) failed after rejected Store(%s): %s", dir, child, err)
+		case !slices.Equal(ls, []string{key}):
+			t.Fatalf("List(%s, true) failed after rejected Store(%s): it should return %#v, not %#v", dir, child, []string{key}, ls)
+		}
+
+		if err := sto.Delete(t.Context(), key); err != nil {
+			t.Fatalf("Delete(%s) failed: %s", key, err)
+		}
+		if err := sto.Store(t.Context(), child, val); err != nil {
+			t.Fatalf("Store(%s) failed: %s", child, err)
+		}
+		if err := sto.Store(t.Context(), key, val); err == nil {
+			t.Fatalf("Store(%s) should fail: the key is a directory", key)
+		}
+		if _, err := sto.Load(t.Context(), child); err != nil {
+			t.Fatalf("Load(%s) failed after rejected Store(%s): %s", child, key, err)
+		}
+		if _, err := sto.Load(t.Context(), key); err == nil && !ts.AllowDirLoad {
+			t.Fatalf("Load(%s) should fail: Store(%s) at the directory key was rejected", key, key)
+		}
+		return
+	}
+
+	// the value may be stored before or after the children
+	for i, childFirst := range []bool{false, true} {
+		key := fmt.Sprintf("%s/x%d", dir, i)
+		child := key + "/y"
+		val := []byte(key)
+		if childFirst {
+			if err := sto.Store(t.Context(), child, val); err != nil {
+				t.Fatalf("Store(%s) failed: %s", child, err)
+			}
+			if err := sto.Store(t.Context(), key, val); err != nil {
+				t.Fatalf("Store(%s) at directory key failed: %s", key, err)
+			}
+		} else {
+			if err := sto.Store(t.Context(), key, val); err != nil {
+				t.Fatalf("Store(%s) failed: %s", key, err)
+			}
+			if err := sto.Store(t.Context(), child, val); err != nil {
+				t.Fatalf("Store(%s) under terminal key failed: %s", child, err)
+			}
+		}
+
+		switch s, err := sto.Load(t.Context(), key); {
+		case err != nil:
+			t.Fatalf("Load(%s) of key with children failed: %s", key, err)
+		case !bytes.Equal(val, s):
+			t.Fatalf("Load(%s) of key with children failed: loaded %#v != stored %#v", key, s, val)
+		}
+
+		switch inf, err := sto.Stat(t.Context(), key); {
+		case err != nil:
+			t.Fatalf("Stat(%s) of key with children failed: %s", key, err)
+		case inf.Key != key:
+			t.Fatalf("Stat(%s) of key with children failed: Key is set to %#v", key, inf.Key)
+		case !inf.IsTerminal:
+			t.Fatalf("Stat(%s) of key with children failed: IsTerminal should be true for keys with a value", key)
+		}
+
+		for _, recursive := range []bool{false, true} {
+			ls, err := sto.List(t.Context(), key, recursive)
+			if err != nil {
+				t.Fatalf("List(%s, %v) of key with children failed: %s", key, recursive, err)
+			}
+			ts.checkListPrefix(t, ls, key, recursive)
+			got := fmt.Sprintf("%#v", ls)
+			exp := fmt.Sprintf("%#v", []string{child})
+			if got != exp {
+				t.Fatalf("List(%s, %v) of key with children failed: it should return %s, not %s", key, recursive, exp, got)
+			}
+		}
+	}
+}
+
+func (ts *Suite) testClients(t *testing.T) {
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+
+	for i, sto := range ts.Clients {
+		key := fmt.Sprintf("%s/k%d", dir, i)
+		val := []byte(key)
+		if err := sto.Store(t.Context(), key, val); err != nil {
+			t.Fatalf("Clients[%d].Store(%s) failed: %s", i, key, err)
+		}
+
+		for j, other := range ts.Clients {
+			if !ts.eventually(ts.ExistsEventuallyConsistent, func() bool { return other.Exists(t.Context(), key) }) {
+				t.Fatalf("Key %s stored by Clients[%d] doesn't exist for Clients[%d]", key, i, j)
+			}
+			var s []byte
+			var err error
+			ts.eventually(false, func() bool {
+				s, err = other.Load(t.Context(), key)
+				return err == nil && bytes.Equal(val, s)
+			})
+			switch {
+			case err != nil:
+				t.Fatalf("Clients[%d].Load(%s) of key stored by Clients[%d] failed: %s", j, key, i, err)
+			case !bytes.Equal(val, s):
+				t.Fatalf("Clients[%d].Load(%s) of key stored by Clients[%d] failed: loaded %#v != stored %#v", j, key, i, s, val)
+			}
+			var ls []string
+			ts.eventually(ts.ListEventuallyConsistent, func() bool {
+				ls, err = other.List(t.Context(), dir, false)
+				return err == nil && slices.Equal(ls, []string{key})
+			})
+			if err != nil {
+				t.Fatalf("Clients[%d].List(%s, false) failed: %s", j, dir, err)
+			} else if !slices.Contains(ls, key) {
+				t.Fatalf("Clients[%d].List(%s, false) failed: key %s stored by Clients[%d] is not listed", j, dir, key, i)
+			} else {
+				ts.checkListSubset(t, ls, dir, false, map[string]bool{key: true})
+			}
+		}
+
+		deleter := (i + 1) % len(ts.Clients)
+		if err := ts.Clients[deleter].Delete(t.Context(), key); err != nil {
+			t.Fatalf("Clients[%d].Delete(%s) failed: %s", deleter, key, err)
+		}
+		for j, other := range ts.Clients {
+			if !ts.eventually(ts.ExistsEventuallyConsistent, func() bool { return !other.Exists(t.Context(), key) }) {
+				t.Fatalf("Key %s deleted by Clients[%d] still exists for Clients[%d]", key, deleter, j)
+			}
+		}
+	}
+}
+
+// testClientsRenewal alternates Clients renewing the same key under its lock,
+// like certmagic instances sharing a storage
+func (ts *Suite) testClientsRenewal(t *testing.T) {
+	if len(ts.Clients) < 2 {
+		return
+	}
+	key := ts.randKey()
+	ts.addCleanupKeys(key)
+
+	var prev []byte
+	for round := 0; round < 3*len(ts.Clients); round++ {
+		i := round % len(ts.Clients)
+		sto := ts.Clients[i]
+		if err := sto.Lock(t.Context(), key); err != nil {
+			t.Fatalf("Clients[%d] fails to lock key: %s", i, err)
+		}
+		switch s, err := sto.Load(t.Context(), key); {
+		case prev == nil && err == nil:
+			sto.Unlock(t.Context(), key)
+			t.Fatalf("Clients[%d].Load(%s) should fail: the key was not stored", i, key)
+		case prev != nil && err != nil:
+			sto.Unlock(t.Context(), key)
+			t.Fatalf("Clients[%d].Load(%s) in round %d failed: %s", i, key, round, err)
+		case prev != nil && !bytes.Equal(prev, s):
+			sto.Unlock(t.Context(), key)
+			t.Fatalf("Clients[%d].Load(%s) in round %d failed: loaded %#v, but the previous round stored %#v", i, key, round, string(s), string(prev))
+		}
+		val := []byte(fmt.Sprintf("round %d by Clients[%d]", round, i))
+		if err := sto.Store(t.Context(), key, val); err != nil {
+			sto.Unlock(t.Context(), key)
+			t.Fatalf("Clients[%d].Store(%s) failed while locked: %s", i, key, err)
+		}
+		if err := sto.Unlock(t.Context(), key); err != nil {
+			t.Fatalf("Clients[%d] fails to unlock locked key: %s", i, err)
+		}
+		prev = val
+	}
+
+	for i, sto := range ts.Clients {
+		switch s, err := sto.Load(t.Context(), key); {
+		case err != nil:
+			t.Fatalf("Clients[%d].Load(%s) failed: %s", i, key, err)
+		case !bytes.Equal(prev, s):
+			t.Fatalf("Clients[%d].Load(%s) failed: loaded %#v, but the last round stored %#v", i, key, string(s), string(prev))
+		}
+	}
+}
+
+func (ts *Suite) testClientsOwnedLocks(t *testing.T) {
+	if !ts.OwnedLocks || len(ts.Clients) < 2 {
+		return
+	}
+	owner, other := ts.Clients[0], ts.Clients[1]
+	key := strconv.Itoa(ts.Rng.Int())
+
+	if err := owner.Lock(t.Context(), key); err != nil {
+		t.Fatalf("Clients[0] fails to lock key: %s", err)
+	}
+
+	if err := other.Unlock(t.Context(), key); err == nil {
+		// a no-op is fine, as long as the lock is still held
+		ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+		defer cancel()
+		if err := other.Lock(ctx, key); err == nil {
+			other.Unlock(t.Context(), key)
+			t.Fatalf("Clients[1] released the lock of key %s held by Clients[0]", key)
+		}
+	}
+	if err := owner.Unlock(t.Context(), key); err != nil {
+		t.Fatalf("Clients[0] fails to unlock locked key after Clients[1] tried to: %s", err)
+	}
+}
+
+// testClientsCrash checks that a client can renew a key whose lock was left
+// behind by a crashed client, and sees what it stored
+func (ts *Suite) testClientsCrash(t *testing.T) {
+	if ts.Crash == nil || len(ts.Clients) < 2 {
+		return
+	}
+	crashed, other := ts.Clients[len(ts.Clients)-1], ts.Clients[0]
+	key := ts.randKey()
+	ts.addCleanupKeys(key)
+	valA := []byte("value A")
+	valB := []byte("value B")
+
+	if err := crashed.Lock(t.Context(), key); err != nil {
+		t.Fatalf("Storage fails to lock key: %s", err)
+	}
+	if err := crashed.Store(t.Context(), key, valA); err != nil {
+		t.Fatalf("Store(%s) failed while locked: %s", key, err)
+	}
+	ts.Crash(crashed)
+
+	// give the lease a margin, like the other lock timeouts
+	ctx, cancel := context.WithTimeout(t.Context(), ts.LockLease+5*time.Second)
+	defer cancel()
+	if err := other.Lock(ctx, key); err != nil {
+		t.Fatalf("Storage fails to lock key left locked by a crashed client after LockLease (%s): %s", ts.LockLease, err)
+	}
+	defer other.Unlock(t.Context(), key)
+	switch s, err := other.Load(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Load(%s) of key stored by a crashed client failed: %s", key, err)
+	case !bytes.Equal(valA, s):
+		t.Fatalf("Load(%s) of key stored by a crashed client failed: loaded %#v != stored %#v", key, string(s), string(valA))
+	}
+	if err := other.Store(t.Context(), key, valB); err != nil {
+		t.Fatalf("Store(%s) failed after recovering the lock of a crashed client: %s", key, err)
+	}
+	switch s, err := other.Load(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Load(%s) failed after recovering the lock of a crashed client: %s", key, err)
+	case !bytes.Equal(valB, s):
+		t.Fatalf("Load(%s) failed after recovering the lock of a crashed client: loaded %#v != stored %#v", key, string(s), string(valB))
+	}
+}
+
+// testConcurrentStores checks concurrent Stores to one key leave one of
+// their values intact, and that a Store after all of them returned wins
+func (ts *Suite) testConcurrentStores(t *testing.T) {
+	sto := ts.S
+	key := ts.randKey()
+	ts.addCleanupKeys(key)
+
+	vals := make([][]byte, ts.concurrency())
+	for i := range vals {
+		// distinct sizes, so Size tells which value it belongs to
+		vals[i] = bytes.Repeat([]byte{byte('a' + i%26)}, 1<<10+i)
+	}
+
+	wg := &sync.WaitGroup{}
+	for _, val := range vals {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer ts.recoverPanic(t)
+			if err := sto.Store(t.Context(), key, val); err != nil {
+				t.Errorf("Store(%s) failed: %s", key, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	s, err := sto.Load(t.Context(), key)
+	if err != nil {
+		t.Fatalf("Load(%s) after concurrent Stores failed: %s", key, err)
+	}
+	if !slices.ContainsFunc(vals, func(val []byte) bool { return bytes.Equal(val, s) }) {
+		t.Fatalf("Load(%s) after concurrent Stores failed: loaded %d bytes are not one of the stored values", key, len(s))
+	}
+	switch inf, err := sto.Stat(t.Context(), key); {
+	case err != nil:
+		t.Fatalf("Stat(%s) after concurrent Stores failed: %s", key, err)
+	case inf.Size != 0 && inf.Size != int64(len(s)):
+		t.Fatalf("Stat(%s) after concurrent Stores failed: Size is %d, but the loaded value has %d bytes", key, inf.Size, len(s))
+	}
+
+	// the last writer, distinct from all the concurrent ones
+	last := []byte(key)
+	if err := sto.Store(t.Context(), key, last); err != nil {
+		t.Fatalf("Store(%s) after concurrent Stores failed: %s", key, err)
+	}
+	ts.eventually(false, func() bool {
+		s, err = sto.Load(t.Context(), key)
+		return err == nil && bytes.Equal(last, s)
+	})
+	switch {
+	case err != nil:
+		t.Fatalf("Load(%s) after the last Store failed: %s", key, err)
+	case !bytes.Equal(last, s):
+		t.Fatalf("Load(%s) after the last Store failed: loaded %d bytes instead of the last stored value %#v", key, len(s), string(last))
+	}
+}
+
+func (ts *Suite) testLoadDuringOverwrites(t *testing.T) {
+	sto := ts.S
+	key := ts.randKey()
+	ts.addCleanupKeys(key)
+	n := ts.OverwriteValueSize
+	if n <= 0 {
+		n = DefaultOverwriteValueSize
+	}
+	vals := [][]byte{
+		bytes.Repeat([]byte{0x00}, n),
+		bytes.Repeat([]byte{0xff}, n),
+	}
+	if err := sto.Store(t.Context(), key, vals[0]); err != nil {
+		t.Fatalf("Store(%s) failed: %s", key, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer ts.recoverPanic(t)
+		for i := 1; i <= 100; i++ {
+			if err := sto.Store(t.Context(), key, vals[i%2]); err != nil {
+				t.Errorf("Store(%s) failed: %s", key, err)
+				return
+			}
+		}
+	}()
+	defer func() { <-done }()
+
+	for loading := true; loading; {
+		select {
+		case <-done:
+			loading = false
+		default:
+		}
+		s, err := sto.Load(t.Context(), key)
+		switch {
+		case err != nil:
+			t.Fatalf("Load(%s) failed during concurrent overwrites: %s", key, err)
+		case len(s) != n:
+			t.Fatalf("Load(%s) failed during concurrent overwrites: loaded %d bytes != stored %d bytes", key, len(s), n)
+		case !bytes.Equal(vals[0], s) && !bytes.Equal(vals[1], s):
+			i := bytes.IndexByte(s, ^s[0])
+			t.Fatalf("Load(%s) failed during concurrent overwrites: loaded value mixes both stored values from offset %d", key, i)
+		}
+	}
+	if t.Failed() {
+		t.FailNow()
+	}
+}
+
+func (ts *Suite) testConcurrentDirCreation(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+
+	// all the keys are in the same new directory, which each Store must create
+	keys := make([]string, ts.concurrency())
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%s/a/b/k%d", dir, i)
+	}
+	start := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for _, k := range keys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer ts.recoverPanic(t)
+			<-start
+			if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+				t.Errorf("Store(%s) failed while other Stores create its directory: %s", k, err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	for _, k := range keys {
+		switch s, err := sto.Load(t.Context(), k); {
+		case err != nil:
+			t.Fatalf("Load(%s) failed: %s", k, err)
+		case !bytes.Equal([]byte(k), s):
+			t.Fatalf("Load(%s) failed: loaded %#v != stored %#v", k, string(s), k)
+		}
+	}
+}
+
+func (ts *Suite) testConcurrentDeletes(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	key := dir + "/k"
+	other := dir + "/other"
+	for _, k := range []string{key, other} {
+		if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+			t.Fatalf("Store(%s) failed: %s", k, err)
+		}
+	}
+
+	// like instances cleaning up the same expired certificate; by the
+	// certmagic.Storage contract, each of them fails only if the key remains
+	start := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for i := 0; i < ts.concurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if err := catchPanic(func() error { return sto.Delete(t.Context(), key) }); err != nil {
+				t.Errorf("Delete(%s) failed during concurrent Deletes: %s", key, err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	if sto.Exists(t.Context(), key) {
+		t.Fatalf("Key %s still exists after concurrent Deletes", key)
+	}
+	if _, err := sto.Load(t.Context(), key); err == nil {
+		t.Fatalf("Load(%s) should fail: the key was deleted", key)
+	}
+	switch s, err := sto.Load(t.Context(), other); {
+	case err != nil:
+		t.Fatalf("Load(%s) failed after concurrent Deletes of %s: %s", other, key, err)
+	case !bytes.Equal([]byte(other), s):
+		t.Fatalf("Load(%s) failed after concurrent Deletes of %s: loaded %#v != stored %#v", other, key, string(s), other)
+	}
+}
+
+func (ts *Suite) testConcurrentDistinctDirs(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+
+	// each key is in its own new directory tree, like certificates issued in bulk
+	dirs := make([]string, ts.concurrency())
+	for i := range dirs {
+		dirs[i] = fmt.Sprintf("%s/p%d", dir, i)
+	}
+	start := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for _, d := range dirs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer ts.recoverPanic(t)
+			<-start
+			k := d + "/a/b"
+			if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+				t.Errorf("Store(%s) failed during concurrent Stores in other directories: %s", k, err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	for _, d := range dirs {
+		k := d + "/a/b"
+		switch s, err := sto.Load(t.Context(), k); {
+		case err != nil:
+			t.Fatalf("Load(%s) failed: %s", k, err)
+		case !bytes.Equal([]byte(k), s):
+			t.Fatalf("Load(%s) failed: loaded %#v != stored %#v", k, string(s), k)
+		}
+		ls, err := sto.List(t.Context(), d, true)
+		if err != nil {
+			t.Fatalf("List(%s, true) failed: %s", d, err)
+		}
+		ts.checkListPrefix(t, ls, d, true)
+		ts.checkListSorted(t, ls, d, true)
+		sort.Strings(ls)
+		got := fmt.Sprintf("%#v", ls)
+		exp := fmt.Sprintf("%#v", []string{d + "/a", k})
+		if got != exp {
+			t.Fatalf("List(%s, true) failed: it should return %s, not %s", d, exp, got)
+		}
+	}
+	ls, err := sto.List(t.Context(), dir, false)
+	if err != nil {
+		t.Fatalf("List(%s, false) failed: %s", dir, err)
+	}
+	ts.checkListPrefix(t, ls, dir, false)
+	ts.checkListSorted(t, ls, dir, false)
+	sort.Strings(ls)
+	sort.Strings(dirs)
+	got := fmt.Sprintf("%#v", ls)
+	exp := fmt.Sprintf("%#v", dirs)
+	if got != exp {
+		t.Fatalf("List(%s, false) failed: it should return %s, not %s", dir, exp, got)
+	}
+}
+
+func (ts *Suite) testStatDuringStores(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	key := dir + "/stat"
+	val := []byte(key)
+
+	if err := sto.Store(t.Context(), key, val); err != nil {
+		t.Fatalf("Store(%s) failed: %s", key, err)
+	}
+	exp, err := sto.Stat(t.Context(), key)
+	if err != nil {
+		t.Fatalf("Stat(%s) failed: %s", key, err)
+	}
+
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer ts.recoverPanic(t)
+			for j := 0; j < 25; j++ {
+				k := fmt.Sprintf("%s/w%d/%d", dir, i, j)
+				if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+					t.Errorf("Store(%s) failed: %s", k, err)
+					return
+				}
+			}
+		}()
+	}
+
+	statDone := make(chan struct{})
+	go func() {
+		defer close(statDone)
+		defer ts.recoverPanic(t)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			switch inf, err := sto.Stat(t.Context(), key); {
+			case err != nil:
+				t.Errorf("Stat(%s) failed during concurrent Stores: %s", key, err)
+				return
+			case inf.Key != exp.Key || inf.Size != exp.Size || inf.IsTerminal != exp.IsTerminal || !inf.Modified.Equal(exp.Modified):
+				t.Errorf("Stat(%s) failed during concurrent Stores: got %#v, but should be %#v", key, inf, exp)
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	<-statDone
+	if t.Failed() {
+		t.FailNow()
+	}
+}
+
+func (ts *Suite) testStatDuringDeletes(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	key := dir + "/stat"
+	val := []byte(key)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer ts.recoverPanic(t)
+		for i := 0; i < 100; i++ {
+			if err := sto.Store(t.Context(), key, val); err != nil {
+				t.Errorf("Store(%s) failed: %s", key, err)
+				return
+			}
+			if err := sto.Delete(t.Context(), key); err != nil {
+				t.Errorf("Delete(%s) failed: %s", key, err)
+				return
+			}
+		}
+	}()
+	defer func() { <-done }()
+
+	for statting := true; statting; {
+		select {
+		case <-done:
+			statting = false
+		default:
+		}
+		switch inf, err := sto.Stat(t.Context(), key); {
+		case err != nil && !errors.Is(err, fs.ErrNotExist):
+			t.Fatalf("Stat(%s) failed during concurrent Deletes: it should fail with fs.ErrNotExist, not %s", key, err)
+		case err != nil:
+		case inf.Key != key:
+			t.Fatalf("Stat(%s) failed during concurrent Deletes: Key is set to %#v", key, inf.Key)
+		case inf.Size != 0 && inf.Size != int64(len(val)):
+			t.Fatalf("Stat(%s) failed during concurrent Deletes: Size is %d, but should be %d", key, inf.Size, len(val))
+		}
+	}
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	if _, err := sto.Stat(t.Context(), key); err == nil {
+		t.Fatalf("Stat(%s) should fail: the key was deleted", key)
+	}
+}
+
+func (ts *Suite) testListDuringStores(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+	val := bytes.Repeat([]byte{'x'}, 64<<10)
+
+	// entries that aren't one of these keys (e.g. temporary files)
+	// are only rejected once all Stores returned
+	keys := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		keys[fmt.Sprintf("%s/k%d", dir, i)] = true
+	}
+	first := dir + "/k0"
+	if err := sto.Store(t.Context(), first, val); err != nil {
+		t.Fatalf("Store(%s) failed: %s", first, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer ts.recoverPanic(t)
+		for i := 1; i < len(keys); i++ {
+			k := fmt.Sprintf("%s/k%d", dir, i)
+			if err := sto.Store(t.Context(), k, val); err != nil {
+				t.Errorf("Store(%s) failed: %s", k, err)
+				return
+			}
+		}
+	}()
+	defer func() { <-done }()
+
+	for listing := true; listing; {
+		select {
+		case <-done:
+			// one last List after all Stores returned
+			listing = false
+		default:
+		}
+		ls, err := sto.List(t.Context(), dir, false)
+		switch {
+		case err != nil && listing && errors.Is(err, fs.ErrNotExist):
+			// certmagic.FileStorage fails to List a directory if a
+			// temporary file disappears while it's being walked
+			continue
+		case err != nil:
+			t.Fatalf("List(%s, false) failed during concurrent Stores: %s", dir, err)
+		}
+		if !listing {
+			ts.checkListSubset(t, ls, dir, false, keys)
+		}
+		for _, k := range ls {
+			if !keys[k] {
+				continue
+			}
+			switch s, err := sto.Load(t.Context(), k); {
+			case err != nil:
+				t.Fatalf("Load(%s) of listed key failed during concurrent Stores: %s", k, err)
+			case !bytes.Equal(val, s):
+				t.Fatalf("Load(%s) of listed key failed during concurrent Stores: loaded %d bytes != stored %d bytes", k, len(s), len(val))
+			}
+		}
+	}
+	if t.Failed() {
+		t.FailNow()
+	}
+}
+
+func (ts *Suite) testListDuringLocks(t *testing.T) {
+	sto := ts.S
+	dir := ts.randKey()
+	ts.addCleanupKeys(dir)
+
+	var keys []string
+	for i := 0; i < 5; i++ {
+		k := fmt.Sprintf("%s/k%d", dir, i)
+		keys = append(keys, k)
+		if err := sto.Store(t.Context(), k, []byte(k)); err != nil {
+			t.Fatalf("Store(%s) failed: %s", k, err)
+		}
+	}
+	exp := fmt.Sprintf("%#v", keys)
+
+	// lock the stored keys, like certmagic locks the names of what it works on
+	ctx, cancel := context.WithCancel(t.Context())
+	wg := &sync.WaitGroup{}
+	for _, k := range keys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer ts.recoverPanic(t)
+			for ctx.Err() == nil {
+				if err := sto.Lock(ctx, k); err != nil {
+					continue
+				}
+				runtime.Gosched()
+				if err := sto.Unlock(t.Context(), k); err != nil {
+					t.Errorf("Storage.Unlock failed: %s", err)
+					return
+				}
+			}
+		}()
+	}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	for i := 0; i < 100; i++ {
+		ls, err := sto.List(t.Context(), dir, true)
+		if err != nil {
+			t.Fatalf("List(%s, true) failed during concurrent Locks: %s", dir, err)
+		}
+		ts.checkListPrefix(t, ls, dir, true)
+		ts.checkListSorted(t, ls, dir, true)
+		sort.Strings(ls)
+		if got := fmt.Sprintf("%#v", ls); got != exp {
+			t.Fatalf("List(%s, true) failed during concurrent Locks: it should return %s, not %s", dir, exp, got)
+		}
+	}
+}
+
+func (ts *Suite) testClose(t *testing.T) {
+	if ts.Close == nil {
+		return
+	}
+	sto := ts.S
+	key := ts.randKey()
+	// without Reopen, the key the Store may leave is small,
+	// and deleted by the next run's randKey
+	val := []byte(key)
+	if ts.Reopen != nil {
+		// large enough to be interrupted by Close, and deleted
+		// through a reopened storage if the Store completes
+		val = bytes.Repeat([]byte{'x'}, 16<<20)
+		defer func() { ts.deleteKey(context.Background(), ts.Reopen(), key) }()
+	}
+
+	// the storage can't be cleaned up once it's closed
+	ts.cleanup(t.Context(), sto)
+
+	stored := make(chan error, 1)
+	go func() {
+		stored <- catchPanic(func() error {
+			return sto.Store(t.Context(), key, val)
+		})
+	}()
+	runtime.Gosched()
+	ts.Close()
+
+	select {
+	case err := <-stored:
+		// the Store may legitimately complete before Close
+		if errors.Is(err, errPanic) {
+			t.Fatalf("Store(%s) interrupted by Close failed: %s", key, err)
+		}
+	case <-time.After(closeTimeout):
+		t.Fatalf("Store(%s) interrupted by Close didn't return after %s", key, closeTimeout)
+	}
+
+	ops := []struct {
+		name string
+		f    func() error
+	}{
+		{"Store", func() error { return sto.Store(t.Context(), key, []byte(key)) }},
+		{"Load", func() error { _, err := sto.Load(t.Context(), key); return err }},
+		{"Stat", func() error { _, err := sto.Stat(t.Context(), key); return err }},
+		{"List", func() error { _, err := sto.List(t.Context(), key, true); return err }},
+		{"Delete", func() error { return sto.Delete(t.Context(), key) }},
+		{"Lock", func() error { return sto.Lock(t.Context(), key) }},
+	}
+	for _, op := range ops {
+		done := make(chan error, 1)
+		go func() { done <- catchPanic(op.f) }()
+		select {
+		case err := <-done:
+			switch {
+			case errors.Is(err, errPanic):
+				t.Fatalf("%s(%s) after Close failed: %s", op.name, key, err)
+			case err == nil:
+				t.Fatalf("%s(%s) after Close should fail: the storage is closed", op.name, key)
+			}
+		case <-time.After(closeTimeout):
+			t.Fatalf("%s(%s) after Close didn't return after %s", op.name, key, closeTimeout)
+		}
+	}
+}
+
+// closeTimeout is how long testClose waits for an operation to return
+const closeTimeout = 10 * time.Second
+
+// errPanic is wrapped by errors returned by catchPanic for recovered panics
+var errPanic = errors.New("panic")
+
+// catchPanic calls f, and converts a panic into an error
+func catchPanic(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", errPanic, r)
+		}
+	}()
+	return f()
+}
+
+// checkStorage fails the test if ts.S is not set,
+// instead of letting the first test panic
+func (ts *Suite) checkStorage(tb testing.TB) {
+	if ts.S == nil {
+		tb.Fatalf("Suite.S is nil: provide a certmagic.Storage")
+	}
+}
+
+// recoverPanic reports a panic of the calling test as a failure,
+// instead of aborting the test binary, so the tested keys still get cleaned up.
+// It must be deferred.
+func (ts *Suite) recoverPanic(tb testing.TB) {
+	if r := recover(); r != nil {
+		tb.Errorf("panic: %v\n%s", r, debug.Stack())
+	}
+}
+
+// cleanup deletes all keys registered with addCleanupKeys from sto
+func (ts *Suite) cleanup(ctx context.Context, sto certmagic.Storage) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for _, k := range ts.randKeys {
+		ts.deleteKey(ctx, sto, k)
+	}
+	ts.randKeys = nil
+}
+
+// checkListPrefix fails the test if List(prefix, recursive) returned
+// keys that are not under prefix, and tells how they differ from the expected keys
+func (ts *Suite) checkListPrefix(tb testing.TB, ls []string, prefix string, recursive bool) {
+	under := prefix + "/"
+	if prefix == "" {
+		under = ""
+	}
+	for _, k := range ls {
+		switch {
+		case strings.HasSuffix(k, "/"):
+			tb.Fatalf("List(%s, %v) failed: it returned keys with an unexpected trailing \"/\", like %#v", prefix, recursive, k)
+		case strings.HasPrefix(k, "/") && strings.HasPrefix(k[1:], under):
+			tb.Fatalf("List(%s, %v) failed: it returned keys with an unexpected leading \"/\", like %#v", prefix, recursive, k)
+		case strings.HasPrefix(k, under):
+		case under != "" && strings.Contains(k, "/"+under):
+			i := strings.Index(k, "/"+under) + 1
+			tb.Fatalf("List(%s, %v) failed: it returned keys with an unexpected prefix %#v, like %#v", prefix, recursive, k[:i], k)
+		case !strings.Contains(k, "/"):
+			tb.Fatalf("List(%s, %v) failed: it returned keys relative to the prefix, like %#v instead of %#v", prefix, recursive, k, under+k)
+		default:
+			tb.Fatalf("List(%s, %v) failed: it returned key %#v, which is not under the prefix", prefix, recursive, k)
+		}
+	}
+}
+
+// checkListSubset fails the test if ls contains a key that isn't in keys,
+// or the same key more than once
+func (ts *Suite) checkListSubset(t *testing.T, ls []string, prefix string, recursive bool, keys map[string]bool) {
+	ts.checkListPrefix(t, ls, prefix, recursive)
+	listed := map[string]bool{}
+	for _, k := range ls {
+		if !keys[k] || listed[k] {
+			t.Fatalf("List(%s, %v) failed: it returned unexpected or duplicate key %#v", prefix, recursive, k)
+		}
+		listed[k] = true
+	}
+}
+
+// checkListSorted fails the test if ts.ListIsSorted is true
+// and List(prefix, recursive) returned the keys ls out of order
+func (ts *Suite) checkListSorted(t *testing.T, ls []string, prefix string, recursive bool) {
+	if ts.ListIsSorted && !sort.StringsAreSorted(ls) {
+		t.Fatalf("List(%s, %v) failed: it should return sorted keys, not %#v", prefix, recursive, ls)
+	}
+}
+
+// patternValue returns a value of n bytes that doesn't repeat at power-of-two offsets
+func patternValue(n int) []byte {
+	val := make([]byte, n)
+	for i := range val {
+		val[i] = byte(i % 251)
+	}
+	return val
+}
+
+// concurrency returns ts.Concurrency, or DefaultConcurrency if it's not set
+func (ts *Suite) concurrency() int {
+	if ts.Concurrency <= 0 {
+		return DefaultConcurrency
+	}
+	return ts.Concurrency
+}
+
+// warmup performs ts.Warmup Store/Load/Delete cycles
+func (ts *Suite) warmup(tb testing.TB) {
+	for i := 0; i < ts.Warmup; i++ {
+		key := ts.randKey()
+		ts.addCleanupKeys(key)
+		if err := ts.S.Store(tb.Context(), key, []byte(key)); err != nil {
+			tb.Fatalf("Warmup: Store(%s) failed: %s", key, err)
+		}
+		if _, err := ts.S.Load(tb.Context(), key); err != nil {
+			tb.Fatalf("Warmup: Load(%s) failed: %s", key, err)
+		}
+		if err := ts.S.Delete(tb.Context(), key); err != nil {
+			tb.Fatalf("Warmup: Delete(%s) failed: %s", key, err)
+		}
+	}
+}
+
+// addCleanupKeys registers keys to be deleted when Run finishes.
+func (ts *Suite) addCleanupKeys(keys ...string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.randKeys = append(ts.randKeys, keys...)
+}
+
+// randKey returns a random key.
+//
+// Since the default Rng always generates the same keys, any residue left
+// at the key by a previous run whose cleanup failed is deleted first.
+func (ts *Suite) randKey() string {
+	key := KeyPrefix + strconv.Itoa(ts.Rng.Int())
+	// not profiled, since no test asked for it
+	ts.deleteKey(context.Background(), untimed(ts.S), key)
+	return key
+}
+
+// untimed returns the Storage s wraps to add latency or profiling in Run,
+// keeping the context values added by ContextDecorator
+func untimed(s certmagic.Storage) certmagic.Storage {
+	for {
+		switch w := s.(type) {
+		case *latencyStorage:
+			s = w.Storage
+		case *profiledStorage:
+			s = w.Storage
+		default:
+			return s
+		}
+	}
+}
+
+// deleteKey deletes key from sto, first deleting the keys under it
+// one by one if ts.RejectDirDelete is true
+func (ts *Suite) deleteKey(ctx context.Context, sto certmagic.Storage, key string) error {
+	if ts.RejectDirDelete {
+		ls, _ := sto.List(ctx, key, true)
+		// in reverse order, the keys under a directory come before it
+		sort.Sort(sort.Reverse(sort.StringSlice(ls)))
+		for _, k := range ls {
+			sto.Delete(ctx, k)
+		}
+	}
+	return sto.Delete(ctx, key)
 }
 
 // NewTestSuite returns a new Suite initalised with storage s
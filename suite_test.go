@@ -1,9 +1,20 @@
 package tests
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/caddyserver/certmagic"
 )
@@ -14,8 +25,535 @@ func TestFileStorage(t *testing.T) {
 		t.Fatalf("Cannot create temp directory: %s", err)
 	}
 	defer os.RemoveAll(tempDir)
-	fs := &certmagic.FileStorage{
-		Path: filepath.Join(tempDir, "filestorage"),
+	path := filepath.Join(tempDir, "filestorage")
+	fs := &closableStorage{
+		FileStorage: &certmagic.FileStorage{Path: path},
 	}
-	NewTestSuite(fs).Run(t)
+	ts := NewTestSuite(fs)
+	setFileSystemKeys(ts)
+	ts.Warmup = 3
+	ts.Close = fs.Close
+	ts.ResourceCheck = openFiles
+	ts.MaxValueSize = 1 << 20
+	ts.MaxDeleteDuration = time.Second
+	ts.LockKeyFor = func(name string) string {
+		return "locks/" + certmagic.StorageKeys.Safe(name) + ".lock"
+	}
+	// FileStorage syncs every Store
+	ts.Sync = func() error { return nil }
+	ts.Reopen = func() certmagic.Storage {
+		return &certmagic.FileStorage{Path: path}
+	}
+	ts.Fresh = func() certmagic.Storage {
+		return &certmagic.FileStorage{Path: filepath.Join(t.TempDir(), "filestorage")}
+	}
+	// filepath.Walk walks directories in lexical order
+	ts.ListIsSorted = true
+	ts.KeepsEmptyDirs = true
+	ts.ModifiedAdvances = true
+	ts.CheckGoroutineLeaks = true
+	ts.Profile = true
+	ts.UsedBytes = func() int64 { return usedBytes(path) }
+	ts.Clients = []certmagic.Storage{ts.Reopen(), ts.Reopen(), ts.Reopen()}
+	ts.Run(t)
+}
+
+// setFileSystemKeys sets the key limitations of the filesystem
+// certmagic.FileStorage runs on by default
+func setFileSystemKeys(ts *Suite) {
+	switch runtime.GOOS {
+	case "darwin", "ios":
+		ts.CaseInsensitiveKeys = true
+		ts.NormalizesKeys = true
+	case "windows":
+		ts.CaseInsensitiveKeys = true
+		ts.WindowsFileNames = true
+	}
+}
+
+func TestFileStorageResidue(t *testing.T) {
+	fs := &certmagic.FileStorage{Path: t.TempDir()}
+	// leave residue at the keys a suite with the same Rng will use,
+	// like a previous run whose cleanup failed
+	residue := NewTestSuite(fs)
+	for i := 0; i < 200; i++ {
+		k := KeyPrefix + strconv.Itoa(residue.Rng.Int())
+		if err := fs.Store(t.Context(), k+"/residue", []byte(k)); err != nil {
+			t.Fatalf("Store(%s) failed: %s", k, err)
+		}
+	}
+	ts := NewTestSuite(fs)
+	setFileSystemKeys(ts)
+	ts.Quick = true
+	ts.KeepsEmptyDirs = true
+	ts.Run(t)
+}
+
+func TestFileStorageLatency(t *testing.T) {
+	fs := &certmagic.FileStorage{Path: t.TempDir()}
+	ts := NewTestSuite(fs)
+	setFileSystemKeys(ts)
+	ts.Latency = 2 * time.Millisecond
+	ts.KeepsEmptyDirs = true
+	ts.Clients = []certmagic.Storage{&certmagic.FileStorage{Path: fs.Path}, &certmagic.FileStorage{Path: fs.Path}}
+	// keep the slow tests from taking minutes
+	ts.LargeListSize = 200
+	ts.ChecksumBytes = 4 << 20
+	ts.Run(t)
+}
+
+// tenantKey is the context key of the value required by tenantStorage
+type tenantKey struct{}
+
+// tenantStorage is a certmagic.FileStorage counting the operations
+// whose context lacks a tenantKey value
+type tenantStorage struct {
+	*certmagic.FileStorage
+	missing atomic.Int64
+}
+
+func (s *tenantStorage) check(ctx context.Context) {
+	if ctx.Value(tenantKey{}) == nil {
+		s.missing.Add(1)
+	}
+}
+
+func (s *tenantStorage) Lock(ctx context.Context, name string) error {
+	s.check(ctx)
+	return s.FileStorage.Lock(ctx, name)
+}
+
+func (s *tenantStorage) Unlock(ctx context.Context, name string) error {
+	s.check(ctx)
+	return s.FileStorage.Unlock(ctx, name)
+}
+
+func (s *tenantStorage) Store(ctx context.Context, key string, value []byte) error {
+	s.check(ctx)
+	return s.FileStorage.Store(ctx, key, value)
+}
+
+func (s *tenantStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	s.check(ctx)
+	return s.FileStorage.Load(ctx, key)
+}
+
+func (s *tenantStorage) Delete(ctx context.Context, key string) error {
+	s.check(ctx)
+	return s.FileStorage.Delete(ctx, key)
+}
+
+func (s *tenantStorage) Exists(ctx context.Context, key string) bool {
+	s.check(ctx)
+	return s.FileStorage.Exists(ctx, key)
+}
+
+func (s *tenantStorage) List(ctx context.Context, path string, recursive bool) ([]string, error) {
+	s.check(ctx)
+	return s.FileStorage.List(ctx, path, recursive)
+}
+
+func (s *tenantStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	s.check(ctx)
+	return s.FileStorage.Stat(ctx, key)
+}
+
+func TestContextDecorator(t *testing.T) {
+	fs := &tenantStorage{FileStorage: &certmagic.FileStorage{Path: t.TempDir()}}
+	ts := NewTestSuite(fs)
+	setFileSystemKeys(ts)
+	ts.Quick = true
+	ts.KeepsEmptyDirs = true
+	ts.ContextDecorator = func(ctx context.Context) context.Context {
+		return context.WithValue(ctx, tenantKey{}, "tenant")
+	}
+	// registered before Run's cleanup, so it runs after it
+	t.Cleanup(func() {
+		if n := fs.missing.Load(); n != 0 {
+			t.Fatalf("%d operations were called without the value added by ContextDecorator", n)
+		}
+	})
+	ts.Run(t)
+}
+
+var errDirDelete = errors.New("directory is not empty")
+
+// dirKeepingStorage is a certmagic.FileStorage failing to Delete
+// directories that are not empty
+type dirKeepingStorage struct {
+	*certmagic.FileStorage
+}
+
+func (s *dirKeepingStorage) Delete(ctx context.Context, key string) error {
+	if ls, _ := s.FileStorage.List(ctx, key, false); len(ls) > 0 {
+		return errDirDelete
+	}
+	return s.FileStorage.Delete(ctx, key)
+}
+
+func TestRejectDirDelete(t *testing.T) {
+	fs := &dirKeepingStorage{FileStorage: &certmagic.FileStorage{Path: t.TempDir()}}
+	ts := NewTestSuite(fs)
+	setFileSystemKeys(ts)
+	ts.Quick = true
+	ts.KeepsEmptyDirs = true
+	ts.RejectDirDelete = true
+	// registered before Run's cleanup, so it runs after it
+	t.Cleanup(func() {
+		ls, err := fs.FileStorage.List(context.Background(), "", true)
+		if err != nil {
+			t.Fatalf("List(\"\", true) failed: %s", err)
+		}
+		for _, k := range ls {
+			if inf, err := fs.Stat(context.Background(), k); err == nil && inf.IsTerminal && strings.HasPrefix(k, KeyPrefix) {
+				t.Fatalf("Key %s was left behind by cleanup", k)
+			}
+		}
+	})
+	ts.Run(t)
+}
+
+// streamingStorage is a certmagic.FileStorage implementing StreamingLister,
+// skipping the keys deleted before they are streamed. It counts the streams,
+// and those whose context lacks a tenantKey value.
+type streamingStorage struct {
+	*certmagic.FileStorage
+	streams atomic.Int64
+	missing atomic.Int64
+}
+
+func (s *streamingStorage) ListStream(ctx context.Context, path string, recursive bool, f func(key string) error) error {
+	s.streams.Add(1)
+	if ctx.Value(tenantKey{}) == nil {
+		s.missing.Add(1)
+	}
+	ls, err := s.FileStorage.List(ctx, path, recursive)
+	if err != nil {
+		return err
+	}
+	for _, k := range ls {
+		if !s.Exists(ctx, k) {
+			continue
+		}
+		if err := f(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestStreamingLister(t *testing.T) {
+	fs := &streamingStorage{FileStorage: &certmagic.FileStorage{Path: t.TempDir()}}
+	ts := NewTestSuite(fs)
+	setFileSystemKeys(ts)
+	ts.Quick = true
+	ts.KeepsEmptyDirs = true
+	// ListStream must go through all the wrappers Run adds
+	ts.ContextDecorator = func(ctx context.Context) context.Context {
+		return context.WithValue(ctx, tenantKey{}, "tenant")
+	}
+	ts.Latency = time.Millisecond
+	ts.Profile = true
+	ts.Run(t)
+	switch {
+	case fs.streams.Load() == 0:
+		t.Fatalf("ListStream was never called")
+	case fs.missing.Load() != 0:
+		t.Fatalf("%d ListStream calls were made without the value added by ContextDecorator", fs.missing.Load())
+	}
+}
+
+// replicationLag is how long replicatedStorage takes to replicate a write
+const replicationLag = 5 * time.Millisecond
+
+// replicatedStorage is a certmagic.FileStorage replicating its Stores
+// and Deletes in the background to a replica, which List and Exists read,
+// and Load and Stat too if staleLoads is set
+type replicatedStorage struct {
+	*certmagic.FileStorage
+	replica    *certmagic.FileStorage
+	staleLoads bool
+
+	mu     sync.Mutex
+	writes chan func()
+}
+
+func newReplicatedStorage(t *testing.T, staleLoads bool) *replicatedStorage {
+	s := &replicatedStorage{
+		FileStorage: &certmagic.FileStorage{Path: t.TempDir()},
+		replica:     &certmagic.FileStorage{Path: t.TempDir()},
+		staleLoads:  staleLoads,
+		writes:      make(chan func(), 1<<16),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for w := range s.writes {
+			w()
+		}
+	}()
+	// registered before Run's cleanup, so it runs after its Deletes
+	t.Cleanup(func() {
+		close(s.writes)
+		<-done
+	})
+	return s
+}
+
+// replicate applies w to the replica after replicationLag,
+// in the order of the writes
+func (s *replicatedStorage) replicate(w func()) {
+	due := time.Now().Add(replicationLag)
+	s.writes <- func() {
+		time.Sleep(time.Until(due))
+		w()
+	}
+}
+
+func (s *replicatedStorage) Store(ctx context.Context, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.FileStorage.Store(ctx, key, value); err != nil {
+		return err
+	}
+	value = bytes.Clone(value)
+	s.replicate(func() { s.replica.Store(context.Background(), key, value) })
+	return nil
+}
+
+func (s *replicatedStorage) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.FileStorage.Delete(ctx, key); err != nil {
+		return err
+	}
+	s.replicate(func() { s.replica.Delete(context.Background(), key) })
+	return nil
+}
+
+func (s *replicatedStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	if s.staleLoads {
+		return s.replica.Load(ctx, key)
+	}
+	return s.FileStorage.Load(ctx, key)
+}
+
+func (s *replicatedStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	if s.staleLoads {
+		return s.replica.Stat(ctx, key)
+	}
+	return s.FileStorage.Stat(ctx, key)
+}
+
+func (s *replicatedStorage) Exists(ctx context.Context, key string) bool {
+	return s.replica.Exists(ctx, key)
+}
+
+func (s *replicatedStorage) List(ctx context.Context, path string, recursive bool) ([]string, error) {
+	return s.replica.List(ctx, path, recursive)
+}
+
+func TestAsyncWrites(t *testing.T) {
+	fs := newReplicatedStorage(t, true)
+	ts := NewTestSuite(fs)
+	setFileSystemKeys(ts)
+	ts.Quick = true
+	ts.KeepsEmptyDirs = true
+	ts.AsyncWrites = true
+	ts.Run(t)
+}
+
+func TestEventualConsistency(t *testing.T) {
+	fs := newReplicatedStorage(t, false)
+	ts := NewTestSuite(fs)
+	setFileSystemKeys(ts)
+	ts.Quick = true
+	ts.KeepsEmptyDirs = true
+	ts.ListEventuallyConsistent = true
+	ts.ExistsEventuallyConsistent = true
+	ts.Run(t)
+}
+
+func BenchmarkFileStorage(b *testing.B) {
+	ts := NewTestSuite(&certmagic.FileStorage{Path: b.TempDir()})
+	ts.BenchmarkMixed(b)
+}
+
+// failureTB records failures instead of failing the test
+type failureTB struct {
+	testing.TB
+	failures []string
+}
+
+func (tb *failureTB) Errorf(format string, args ...any) {
+	tb.failures = append(tb.failures, fmt.Sprintf(format, args...))
+}
+
+func (tb *failureTB) Fatalf(format string, args ...any) {
+	tb.failures = append(tb.failures, fmt.Sprintf(format, args...))
+}
+
+func TestCheckStorage(t *testing.T) {
+	tb := &failureTB{TB: t}
+	NewTestSuite(nil).checkStorage(tb)
+	if len(tb.failures) != 1 || !strings.HasPrefix(tb.failures[0], "Suite.S is nil") {
+		t.Fatalf("Nil storage wasn't reported as a failure: %#v", tb.failures)
+	}
+}
+
+func TestCheckListPrefix(t *testing.T) {
+	ts := NewTestSuite(nil)
+	for _, c := range []struct {
+		ls        []string
+		diagnosis string
+	}{
+		{[]string{"dir/a", "dir/b/c"}, ""},
+		{[]string{"/dir/a"}, `unexpected leading "/"`},
+		{[]string{"dir/a/"}, `unexpected trailing "/"`},
+		{[]string{"root/dir/a"}, `unexpected prefix "root/"`},
+		{[]string{"a"}, "relative to the prefix"},
+		{[]string{"other/a"}, "not under the prefix"},
+	} {
+		tb := &failureTB{TB: t}
+		ts.checkListPrefix(tb, c.ls, "dir", true)
+		switch {
+		case c.diagnosis == "" && len(tb.failures) != 0:
+			t.Fatalf("Keys %#v under the prefix were reported as a failure: %#v", c.ls, tb.failures)
+		case c.diagnosis != "" && (len(tb.failures) == 0 || !strings.Contains(tb.failures[0], c.diagnosis)):
+			t.Fatalf("Keys %#v weren't reported with %#v: %#v", c.ls, c.diagnosis, tb.failures)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	fs := &certmagic.FileStorage{Path: t.TempDir()}
+	// registered before Replay's cleanup, so it runs after it
+	t.Cleanup(func() {
+		ls, err := fs.List(context.Background(), "", false)
+		if err != nil {
+			t.Fatalf("List(\"\", false) failed: %s", err)
+		}
+		for _, k := range ls {
+			if strings.HasPrefix(k, KeyPrefix) {
+				t.Fatalf("Key %s was left behind by Replay", k)
+			}
+		}
+	})
+	NewTestSuite(fs).Replay(t, CertmagicTrace)
+}
+
+func TestSupportedSegments(t *testing.T) {
+	segs := []string{"Key", "key", "a:b", "a b", "a ", "a.", "a\tb", "a.b"}
+	for _, c := range []struct {
+		caseInsensitive, windows bool
+		supported                []string
+	}{
+		{false, false, segs},
+		{true, false, []string{"Key", "a:b", "a b", "a ", "a.", "a\tb", "a.b"}},
+		{false, true, []string{"Key", "key", "a b", "a.b"}},
+	} {
+		ts := NewTestSuite(nil)
+		ts.CaseInsensitiveKeys = c.caseInsensitive
+		ts.WindowsFileNames = c.windows
+		if got := ts.supportedSegments(segs); !slices.Equal(got, c.supported) {
+			t.Fatalf("supportedSegments with CaseInsensitiveKeys %v and WindowsFileNames %v returned %#v, not %#v", c.caseInsensitive, c.windows, got, c.supported)
+		}
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	ts := NewTestSuite(&certmagic.FileStorage{Path: t.TempDir()})
+	tb := &failureTB{TB: t}
+	func() {
+		defer ts.recoverPanic(tb)
+		panic("storage panicked")
+	}()
+	if len(tb.failures) != 1 || !strings.HasPrefix(tb.failures[0], "panic: storage panicked") {
+		t.Fatalf("Panic wasn't reported as a failure: %#v", tb.failures)
+	}
+}
+
+// usedBytes returns the total size of the files in dir
+func usedBytes(dir string) int64 {
+	var n int64
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			n += info.Size()
+		}
+		return nil
+	})
+	return n
+}
+
+// openFiles returns the number of open file descriptors on Linux, and 0 elsewhere
+func openFiles() int {
+	fds, _ := os.ReadDir("/proc/self/fd")
+	return len(fds)
+}
+
+var errClosed = errors.New("storage is closed")
+
+// closableStorage is a certmagic.FileStorage that fails all operations once closed
+type closableStorage struct {
+	*certmagic.FileStorage
+	closed atomic.Bool
+}
+
+func (s *closableStorage) Close() {
+	s.closed.Store(true)
+}
+
+func (s *closableStorage) Lock(ctx context.Context, name string) error {
+	if s.closed.Load() {
+		return errClosed
+	}
+	return s.FileStorage.Lock(ctx, name)
+}
+
+func (s *closableStorage) Unlock(ctx context.Context, name string) error {
+	if s.closed.Load() {
+		return errClosed
+	}
+	return s.FileStorage.Unlock(ctx, name)
+}
+
+func (s *closableStorage) Store(ctx context.Context, key string, value []byte) error {
+	if s.closed.Load() {
+		return errClosed
+	}
+	return s.FileStorage.Store(ctx, key, value)
+}
+
+func (s *closableStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	if s.closed.Load() {
+		return nil, errClosed
+	}
+	return s.FileStorage.Load(ctx, key)
+}
+
+func (s *closableStorage) Delete(ctx context.Context, key string) error {
+	if s.closed.Load() {
+		return errClosed
+	}
+	return s.FileStorage.Delete(ctx, key)
+}
+
+func (s *closableStorage) Exists(ctx context.Context, key string) bool {
+	return !s.closed.Load() && s.FileStorage.Exists(ctx, key)
+}
+
+func (s *closableStorage) List(ctx context.Context, path string, recursive bool) ([]string, error) {
+	if s.closed.Load() {
+		return nil, errClosed
+	}
+	return s.FileStorage.List(ctx, path, recursive)
+}
+
+func (s *closableStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	if s.closed.Load() {
+		return certmagic.KeyInfo{}, errClosed
+	}
+	return s.FileStorage.Stat(ctx, key)
 }